@@ -7,17 +7,22 @@ import (
 	"os"
 	"strings"
 
+	"github.com/devanshbatham/ip2cloud/internal/feeds"
 	"github.com/devanshbatham/ip2cloud/internal/store"
+	"github.com/devanshbatham/ip2cloud/internal/trie"
 )
 
 func runAdd(args []string) {
 	addUsage := func() {
-		fmt.Fprintf(os.Stderr, "Usage: ip2cloud add <provider> [-f file] [cidrs...]\n\n")
+		fmt.Fprintf(os.Stderr, "Usage: ip2cloud add <provider> [-f file] [-format name] [cidrs...]\n\n")
 		fmt.Fprintf(os.Stderr, "Add CIDR ranges for a cloud provider.\n")
 		fmt.Fprintf(os.Stderr, "CIDRs can be passed as arguments, from a file (-f), or piped via stdin (-f -).\n\n")
 		fmt.Fprintf(os.Stderr, "Flags:\n")
-		fmt.Fprintf(os.Stderr, "  -f string    Read CIDRs from a file (use '-' for stdin)\n")
-		fmt.Fprintf(os.Stderr, "  -build       Rebuild binary trie after adding (default: true)\n")
+		fmt.Fprintf(os.Stderr, "  -f string       Read CIDRs from a file (use '-' for stdin)\n")
+		fmt.Fprintf(os.Stderr, "  -format string  Format of the -f file: text or %s (default: text)\n", strings.Join(feeds.Formats(), ", "))
+		fmt.Fprintf(os.Stderr, "  -y              Overwrite an existing provider without asking\n")
+		fmt.Fprintf(os.Stderr, "  -strict         Fail if any range is invalid instead of skipping it\n")
+		fmt.Fprintf(os.Stderr, "  -build          Rebuild binary trie after adding (default: true)\n")
 	}
 
 	if len(args) < 1 || args[0] == "-h" || args[0] == "--help" {
@@ -28,10 +33,16 @@ func runAdd(args []string) {
 		os.Exit(1)
 	}
 
-	provider := args[0]
+	provider, err := store.ParseProviderName(args[0])
+	if err != nil {
+		fatal("%v", err)
+	}
 
 	fs := flag.NewFlagSet("add", flag.ExitOnError)
 	file := fs.String("f", "", "Read CIDRs from a file (use '-' for stdin)")
+	format := fs.String("format", "text", "Format of the -f file")
+	yes := fs.Bool("y", false, "Overwrite an existing provider without asking")
+	strict := fs.Bool("strict", false, "Fail if any range is invalid instead of skipping it")
 	rebuild := fs.Bool("build", true, "Rebuild binary trie after adding")
 	fs.Usage = addUsage
 	fs.Parse(args[1:])
@@ -50,35 +61,70 @@ func runAdd(args []string) {
 			}
 			defer r.Close()
 		}
-		sc := bufio.NewScanner(r)
-		for sc.Scan() {
-			line := strings.TrimSpace(sc.Text())
-			if line != "" && !strings.HasPrefix(line, "#") {
-				cidrs = append(cidrs, line)
+		if *format == "text" {
+			lines, err := store.ScanRanges(r)
+			if err != nil {
+				fatal("reading input: %v", err)
 			}
+			cidrs = append(cidrs, lines...)
+		} else {
+			imported, err := feeds.Import(*format, r)
+			if err != nil {
+				fatal("importing %s: %v", *file, err)
+			}
+			cidrs = append(cidrs, imported...)
 		}
-		if err := sc.Err(); err != nil {
-			fatal("reading input: %v", err)
-		}
+	} else if *format != "text" {
+		fatal("-format %s needs an input file (-f file, or -f - for stdin)", *format)
 	}
 
 	if len(cidrs) == 0 {
 		fatal("no CIDRs provided. Use arguments, -f file, or -f - for stdin.")
 	}
 
+	valid := cidrs[:0]
+	invalid, normalized := 0, 0
+	for _, line := range cidrs {
+		norm, err := trie.NormalizeRange(line)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid: %s: %v\n", line, err)
+			invalid++
+			continue
+		}
+		if norm != line {
+			normalized++
+		}
+		valid = append(valid, norm)
+	}
+	if invalid > 0 && *strict {
+		fatal("%d invalid ranges, nothing written", invalid)
+	}
+	if invalid > 0 {
+		fmt.Fprintf(os.Stderr, "warning: skipped %d invalid ranges\n", invalid)
+	}
+	if normalized > 0 {
+		fmt.Fprintf(os.Stderr, "Normalized %d ranges (host bits cleared or /32 and /128 added)\n", normalized)
+	}
+	if len(valid) == 0 {
+		fatal("no valid CIDRs to add")
+	}
+	cidrs = valid
+
 	s, err := store.DefaultStore()
 	if err != nil {
 		fatal("%v", err)
 	}
 
 	if s.ProviderExists(provider) {
-		fmt.Printf("Provider '%s' already exists. Overwrite? [y/N]: ", provider)
-		reader := bufio.NewReader(os.Stdin)
-		answer, _ := reader.ReadString('\n')
-		answer = strings.TrimSpace(strings.ToLower(answer))
-		if answer != "y" && answer != "yes" {
-			fmt.Println("Aborted.")
-			return
+		if !*yes {
+			fmt.Printf("Provider '%s' already exists. Overwrite? [y/N]: ", provider)
+			reader := bufio.NewReader(os.Stdin)
+			answer, _ := reader.ReadString('\n')
+			answer = strings.TrimSpace(strings.ToLower(answer))
+			if answer != "y" && answer != "yes" {
+				fmt.Println("Aborted.")
+				return
+			}
 		}
 		if err := s.OverwriteRanges(provider, cidrs); err != nil {
 			fatal("overwriting ranges: %v", err)
@@ -3,31 +3,47 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io/fs"
 	"os"
-	"path/filepath"
 	"strings"
+	"text/tabwriter"
 
 	ip2cloud "github.com/devanshbatham/ip2cloud"
 	"github.com/devanshbatham/ip2cloud/internal/store"
+	"github.com/devanshbatham/ip2cloud/internal/trie"
 )
 
 func runBuild(args []string) {
 	fs := flag.NewFlagSet("build", flag.ExitOnError)
 	seedDir := fs.String("seed", "", "Seed data from a directory of .txt files (e.g., ./data)")
+	layoutFlag := fs.String("layout", "", "Trie layout to write: binary or poptrie (default: the current layout)")
+	signKey := fs.String("sign", "", "Sign the trie with the ed25519 private key in this PEM file")
 	fs.Parse(args)
 
 	s, err := store.DefaultStore()
 	if err != nil {
 		fatal("%v", err)
 	}
+	if *layoutFlag != "" {
+		layout, err := trie.ParseLayout(*layoutFlag)
+		if err != nil {
+			fatal("%v", err)
+		}
+		s.Layout = &layout
+	}
+	if *signKey != "" {
+		if s.SigningKey, err = store.ReadPrivateKey(*signKey); err != nil {
+			fatal("reading signing key: %v", err)
+		}
+	} else if len(s.TrustedKeys) > 0 {
+		fmt.Fprintf(os.Stderr, "warning: %s exists, so lookups will refuse this unsigned trie; use -sign\n", s.TrustedKeysPath())
+	}
 
 	if err := s.Init(); err != nil {
 		fatal("creating data dir: %v", err)
 	}
 
 	if *seedDir != "" {
-		if err := seedFromDir(s, *seedDir); err != nil {
+		if err := s.SeedFromDir(*seedDir); err != nil {
 			fatal("seeding: %v", err)
 		}
 	} else {
@@ -49,21 +65,20 @@ func runBuild(args []string) {
 		fmt.Fprintf(os.Stderr, "warning: %s\n", w)
 	}
 
-	providers := t.Providers[1:]
-	fmt.Printf("Built trie: %d providers, saved to %s\n", len(providers), s.BinPath)
-}
-
-func seedFromDir(s *store.Store, dir string) error {
-	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
-		if err != nil || d.IsDir() || !strings.HasSuffix(d.Name(), ".txt") {
-			return err
+	if len(t.Conflicts) > 0 {
+		fmt.Fprintf(os.Stderr, "%d prefixes are listed by more than one provider:\n", len(t.Conflicts))
+		w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+		for _, c := range t.Conflicts {
+			winner := c.Providers[len(c.Providers)-1]
+			fmt.Fprintf(w, "  %s\t%s\t(lookups report %s)\n", c.Prefix, strings.Join(c.Providers, ", "), winner)
 		}
+		w.Flush()
+	}
 
-		src, err := os.ReadFile(path)
-		if err != nil {
-			return err
-		}
-		dst := filepath.Join(s.DataDir, d.Name())
-		return os.WriteFile(dst, src, 0644)
-	})
+	providers := t.Providers[1:]
+	signed := ""
+	if s.SigningKey != nil {
+		signed = ", signed"
+	}
+	fmt.Printf("Built trie (%s layout%s): %d providers, saved to %s\n", t.Layout(), signed, len(providers), s.BinPath)
 }
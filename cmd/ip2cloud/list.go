@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"os"
+	"sort"
+	"strings"
 	"text/tabwriter"
 
 	"github.com/devanshbatham/ip2cloud/internal/store"
@@ -24,13 +26,46 @@ func runList() {
 		return
 	}
 
+	groups, err := s.LoadGroups()
+	if err != nil {
+		fatal("loading groups: %v", err)
+	}
+
+	// Providers reported under an alias are counted with their target.
+	var names []string
+	counts := make(map[string]int)
+	aliases := make(map[string][]string)
+	for _, p := range providers {
+		name := groups.Canonical(p.Name)
+		if _, ok := counts[name]; !ok {
+			names = append(names, name)
+		}
+		counts[name] += p.RangeCount
+		if name != p.Name {
+			aliases[name] = append(aliases[name], p.Name)
+		}
+	}
+
+	sort.Strings(names)
+
 	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
 	fmt.Fprintln(w, "PROVIDER\tRANGES")
 	total := 0
-	for _, p := range providers {
-		fmt.Fprintf(w, "%s\t%d\n", p.Name, p.RangeCount)
-		total += p.RangeCount
+	for _, name := range names {
+		note := ""
+		if a := aliases[name]; len(a) > 0 {
+			note = " (includes " + strings.Join(a, ", ") + ")"
+		}
+		fmt.Fprintf(w, "%s\t%d%s\n", name, counts[name], note)
+		total += counts[name]
 	}
 	fmt.Fprintf(w, "\t\nTOTAL\t%d\n", total)
+
+	if groupNames := groups.GroupNames(); len(groupNames) > 0 {
+		fmt.Fprintf(w, "\t\nGROUP\tPROVIDERS\n")
+		for _, g := range groupNames {
+			fmt.Fprintf(w, "%s\t%s\n", g, strings.Join(groups.Members(g), ", "))
+		}
+	}
 	w.Flush()
 }
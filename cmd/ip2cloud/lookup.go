@@ -3,10 +3,13 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"net/netip"
 	"os"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
 
@@ -19,6 +22,283 @@ const batchSize = 4096
 type result struct {
 	ip       string
 	provider string
+	prefix   string
+	match    ip2cloud.Result
+	invalid  bool
+}
+
+// Labels for IPs without a matching provider and for lines that are not IP
+// addresses. They are also the JSON keys these results are grouped under.
+const (
+	labelNone    = "none"
+	labelInvalid = "invalid"
+)
+
+func matchResult(ip string, m ip2cloud.Result, withPrefix bool) result {
+	r := result{ip: ip, provider: m.Provider, match: m}
+	if withPrefix {
+		r.prefix = m.Prefix.String()
+	}
+	return r
+}
+
+func (r result) label(showMeta bool) string {
+	if showMeta {
+		return r.match.Label()
+	}
+	return r.provider
+}
+
+// A batch is a run of input lines, numbered so that results can be printed
+// in input order.
+type batch struct {
+	seq int
+	ips []string
+}
+
+type resultBatch struct {
+	seq     int
+	results []result
+}
+
+// reorder passes each batch of results to emit in sequence order, holding
+// back batches that finish before an earlier one. done is called after
+// each batch is emitted.
+func reorder(in <-chan resultBatch, emit func([]result), done func()) {
+	pending := make(map[int][]result)
+	next := 0
+	for b := range in {
+		pending[b.seq] = b.results
+		for {
+			results, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			emit(results)
+			done()
+			next++
+		}
+	}
+}
+
+// readAhead is how many batches per worker may be read before the batch
+// being printed. It bounds the results held back by reorder, so a slow
+// batch cannot make the ordered output buffer the rest of the input.
+const readAhead = 4
+
+// process reads batches with read, runs lookup on each across workers
+// goroutines and passes the results to emit, in input order unless
+// unordered is set.
+func process(read func(send func(ips []string)), workers int, unordered bool, lookup func(ips []string) []result, emit func([]result)) {
+	ipCh := make(chan batch, workers*2)
+	resCh := make(chan resultBatch, workers*2)
+	window := make(chan struct{}, workers*readAhead)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range ipCh {
+				resCh <- resultBatch{seq: b.seq, results: lookup(b.ips)}
+			}
+		}()
+	}
+
+	go func() {
+		seq := 0
+		read(func(ips []string) {
+			window <- struct{}{}
+			ipCh <- batch{seq: seq, ips: ips}
+			seq++
+		})
+		close(ipCh)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(resCh)
+	}()
+
+	release := func() { <-window }
+	if !unordered {
+		reorder(resCh, emit, release)
+		return
+	}
+	for b := range resCh {
+		emit(b.results)
+		release()
+	}
+}
+
+// A classifier looks up batches of input lines and labels the results as
+// the lookup flags ask.
+type classifier struct {
+	lookup    *ip2cloud.Lookup
+	groups    *store.Groups
+	providers []string // selected with -p; empty allows every provider
+
+	all, cidr, meta bool
+	none, invert    bool
+}
+
+// check rejects flags that contradict each other.
+func (c *classifier) check() error {
+	if c.none && c.invert {
+		return errors.New("-n and -x cannot be used together")
+	}
+	return nil
+}
+
+// allowed reports whether provider passes the -p filter.
+func (c *classifier) allowed(provider string) bool {
+	if len(c.providers) == 0 {
+		return true
+	}
+	provider = strings.ToLower(provider)
+	for _, p := range c.providers {
+		if ip2cloud.Within(provider, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// covering returns the most specific range of an allowed provider that
+// covers addr, which with -p need not be the longest match.
+func (c *classifier) covering(addr netip.Addr) (ip2cloud.Result, bool) {
+	for _, m := range c.lookup.All(addr) {
+		m.Provider = c.groups.Canonical(m.Provider)
+		if c.allowed(m.Provider) {
+			return m, true
+		}
+	}
+	return ip2cloud.Result{}, false
+}
+
+// classify returns the results for ips in input order. Invalid lines are
+// always included, marked invalid, so the caller decides where they go.
+func (c *classifier) classify(ips []string) []result {
+	var results []result
+	for _, ip := range ips {
+		addr, err := ip2cloud.ParseAddr(ip)
+		if err != nil {
+			results = append(results, result{ip: ip, provider: labelInvalid, invalid: true})
+			continue
+		}
+		first := len(results)
+		if c.all {
+			for _, m := range c.lookup.All(addr) {
+				m.Provider = c.groups.Canonical(m.Provider)
+				r := matchResult(ip, m, c.cidr)
+				// Aliased providers can repeat a line already printed.
+				dup := slices.ContainsFunc(results[first:], func(e result) bool {
+					return e.prefix == r.prefix && e.label(c.meta) == r.label(c.meta)
+				})
+				if c.allowed(r.provider) && !dup {
+					results = append(results, r)
+				}
+			}
+		} else if c.cidr || c.meta {
+			if m, ok := c.lookup.Match(addr); ok {
+				m.Provider = c.groups.Canonical(m.Provider)
+				if r := matchResult(ip, m, c.cidr); c.allowed(r.provider) {
+					results = append(results, r)
+				}
+			}
+		} else if provider := c.lookup.Provider(addr); provider != "" {
+			if r := (result{ip: ip, provider: c.groups.Canonical(provider)}); c.allowed(r.provider) {
+				results = append(results, r)
+			}
+		}
+
+		matched := len(results) > first
+		if c.invert {
+			results = results[:first]
+		}
+		if matched || !c.none && !c.invert {
+			continue
+		}
+		// With -p the longest match may belong to another provider while a
+		// selected one still covers the IP, so it is not unmatched. -n prints
+		// it under the selected provider, so every IP still gets a line.
+		if len(c.providers) > 0 {
+			if m, ok := c.covering(addr); ok {
+				if c.none {
+					results = append(results, matchResult(ip, m, c.cidr))
+				}
+				continue
+			}
+		}
+		results = append(results, result{ip: ip, provider: labelNone, match: ip2cloud.Result{Provider: labelNone}})
+	}
+	return results
+}
+
+// invalidBucket reports whether invalid lines are listed under their own
+// JSON key instead of on stderr.
+func (c *classifier) invalidBucket(jsonOutput bool) bool {
+	return jsonOutput && (c.none || c.invert)
+}
+
+// line formats r for text output.
+func (c *classifier) line(r result) string {
+	switch {
+	case c.invert:
+		return r.ip
+	case c.cidr && r.prefix != "":
+		return fmt.Sprintf("[%s] %s %s", r.label(c.meta), r.ip, r.prefix)
+	default:
+		return fmt.Sprintf("[%s] %s", r.label(c.meta), r.ip)
+	}
+}
+
+type jsonMatch struct {
+	IP      string `json:"ip"`
+	Prefix  string `json:"prefix,omitempty"`
+	Region  string `json:"region,omitempty"`
+	Zone    string `json:"zone,omitempty"`
+	Service string `json:"service,omitempty"`
+	Source  string `json:"source,omitempty"`
+}
+
+// jsonGroups collects results for JSON output, keyed by provider. When
+// detailed, each IP is an object carrying its prefix and metadata.
+type jsonGroups struct {
+	detailed bool
+	ips      map[string][]string
+	matches  map[string][]jsonMatch
+}
+
+func newJSONGroups(detailed bool) *jsonGroups {
+	return &jsonGroups{
+		detailed: detailed,
+		ips:      make(map[string][]string),
+		matches:  make(map[string][]jsonMatch),
+	}
+}
+
+func (g *jsonGroups) add(r result) {
+	if !g.detailed {
+		g.ips[r.provider] = append(g.ips[r.provider], r.ip)
+		return
+	}
+	g.matches[r.provider] = append(g.matches[r.provider], jsonMatch{
+		IP:      r.ip,
+		Prefix:  r.prefix,
+		Region:  r.match.Region,
+		Zone:    r.match.Zone,
+		Service: r.match.Service,
+		Source:  r.match.Source,
+	})
+}
+
+func (g *jsonGroups) value() any {
+	if g.detailed {
+		return g.matches
+	}
+	return g.ips
 }
 
 func runLookup(args []string) {
@@ -28,109 +308,115 @@ func runLookup(args []string) {
 	workers := fs.Int("w", runtime.NumCPU(), "Number of concurrent workers")
 	providerFlag := fs.String("provider", "", "Only check against specific providers (comma-separated, e.g., aws,gcp)")
 	fs.StringVar(providerFlag, "p", "", "Only check against specific providers (comma-separated, e.g., aws,gcp)")
+	showCIDR := fs.Bool("cidr", false, "Print the matched CIDR for each IP")
+	fs.BoolVar(showCIDR, "c", false, "Print the matched CIDR for each IP")
+	showMeta := fs.Bool("meta", false, "Print region and service metadata for each match")
+	fs.BoolVar(showMeta, "m", false, "Print region and service metadata for each match")
+	allMatches := fs.Bool("all", false, "Print every provider whose range covers the IP, not only the longest match")
+	fs.BoolVar(allMatches, "a", false, "Print every provider whose range covers the IP, not only the longest match")
+	unordered := fs.Bool("unordered", false, "Print results as workers finish them instead of in input order")
+	fs.BoolVar(unordered, "u", false, "Print results as workers finish them instead of in input order")
+	showNone := fs.Bool("none", false, "Also print IPs with no matching provider, labelled none")
+	fs.BoolVar(showNone, "n", false, "Also print IPs with no matching provider, labelled none")
+	invert := fs.Bool("invert", false, "Print only IPs with no matching provider, like grep -v")
+	fs.BoolVar(invert, "x", false, "Print only IPs with no matching provider, like grep -v")
 	fs.Parse(args)
 
 	if *workers < 1 {
 		*workers = 1
 	}
-
-	allowedProviders := make(map[string]bool)
-	if *providerFlag != "" {
-		for _, p := range strings.Split(*providerFlag, ",") {
-			p = strings.TrimSpace(p)
-			if p != "" {
-				allowedProviders[strings.ToLower(p)] = true
-			}
-		}
+	c := &classifier{
+		all:    *allMatches,
+		cidr:   *showCIDR,
+		meta:   *showMeta,
+		none:   *showNone,
+		invert: *invert,
+	}
+	if err := c.check(); err != nil {
+		fatal("%v", err)
 	}
 
 	s, err := store.DefaultStore()
 	if err != nil {
 		fatal("%v", err)
 	}
-
-	embeddedData, err := ip2cloud.EmbeddedData()
+	c.groups, err = s.LoadGroups()
 	if err != nil {
-		fatal("loading embedded data: %v", err)
+		fatal("loading groups: %v", err)
+	}
+
+	if *providerFlag != "" {
+		var names []string
+		for _, p := range strings.Split(*providerFlag, ",") {
+			p = strings.Trim(strings.TrimSpace(p), "/")
+			if p != "" {
+				names = append(names, p)
+			}
+		}
+		c.providers = c.groups.Expand(names)
 	}
 
-	trie, err := s.LoadOrBuildTrie(embeddedData)
+	c.lookup, err = ip2cloud.Default()
 	if err != nil {
 		fatal("loading trie: %v", err)
 	}
 
-	for _, w := range trie.Warnings {
+	for _, w := range c.lookup.Warnings() {
 		fmt.Fprintf(os.Stderr, "warning: %s\n", w)
 	}
 
-	ipCh := make(chan []string, *workers*2)
-	resCh := make(chan []result, *workers*2)
-
-	var wg sync.WaitGroup
-	for i := 0; i < *workers; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for batch := range ipCh {
-				var results []result
-				for _, ip := range batch {
-					provider := trie.Lookup(ip)
-					if provider == "" {
-						continue
-					}
-					if len(allowedProviders) > 0 && !allowedProviders[strings.ToLower(provider)] {
-						continue
-					}
-					results = append(results, result{ip: ip, provider: provider})
-				}
-				if len(results) > 0 {
-					resCh <- results
-				}
-			}
-		}()
-	}
-
-	go func() {
+	read := func(send func(ips []string)) {
 		if positional := fs.Args(); len(positional) > 0 {
-			ipCh <- positional
+			send(positional)
 		} else {
 			scanner := bufio.NewScanner(os.Stdin)
 			scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
-			batch := make([]string, 0, batchSize)
+			ips := make([]string, 0, batchSize)
 			for scanner.Scan() {
 				ip := strings.TrimSpace(scanner.Text())
 				if ip == "" {
 					continue
 				}
-				batch = append(batch, ip)
-				if len(batch) >= batchSize {
-					ipCh <- batch
-					batch = make([]string, 0, batchSize)
+				ips = append(ips, ip)
+				if len(ips) >= batchSize {
+					send(ips)
+					ips = make([]string, 0, batchSize)
 				}
 			}
 			if err := scanner.Err(); err != nil {
 				fmt.Fprintf(os.Stderr, "error reading stdin: %v\n", err)
 			}
-			if len(batch) > 0 {
-				ipCh <- batch
+			if len(ips) > 0 {
+				send(ips)
 			}
 		}
-		close(ipCh)
-	}()
+	}
 
-	go func() {
-		wg.Wait()
-		close(resCh)
-	}()
+	// Invalid lines go in their own JSON bucket when unmatched IPs are
+	// shown too; otherwise they are reported on stderr.
+	invalidBucket := c.invalidBucket(*jsonOutput)
+	reportInvalid := func(r result) bool {
+		if r.invalid && !invalidBucket {
+			fmt.Fprintf(os.Stderr, "invalid: %s\n", r.ip)
+			return true
+		}
+		return false
+	}
+
+	collect := func(emit func([]result)) {
+		process(read, *workers, *unordered, c.classify, emit)
+	}
 
 	if *jsonOutput {
-		grouped := make(map[string][]string)
-		for batch := range resCh {
-			for _, r := range batch {
-				grouped[r.provider] = append(grouped[r.provider], r.ip)
+		groups := newJSONGroups(*showCIDR || *showMeta)
+		collect(func(results []result) {
+			for _, r := range results {
+				if !reportInvalid(r) {
+					groups.add(r)
+				}
 			}
-		}
-		out, err := json.MarshalIndent(grouped, "", "    ")
+		})
+		out, err := json.MarshalIndent(groups.value(), "", "    ")
 		if err != nil {
 			fatal("marshaling JSON: %v", err)
 		}
@@ -138,11 +424,13 @@ func runLookup(args []string) {
 		os.Stdout.Write([]byte("\n"))
 	} else {
 		w := bufio.NewWriterSize(os.Stdout, 256*1024)
-		for batch := range resCh {
-			for _, r := range batch {
-				fmt.Fprintf(w, "[%s] %s\n", r.provider, r.ip)
+		collect(func(results []result) {
+			for _, r := range results {
+				if !reportInvalid(r) {
+					fmt.Fprintln(w, c.line(r))
+				}
 			}
-		}
+		})
 		if err := w.Flush(); err != nil {
 			fatal("flushing output: %v", err)
 		}
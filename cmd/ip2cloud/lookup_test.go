@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ip2cloud "github.com/devanshbatham/ip2cloud"
+	"github.com/devanshbatham/ip2cloud/internal/store"
+)
+
+func ips(n, start int) []string {
+	out := make([]string, n)
+	for i := range out {
+		out[i] = strconv.Itoa(start + i)
+	}
+	return out
+}
+
+func toResults(ips []string) []result {
+	out := make([]result, len(ips))
+	for i, ip := range ips {
+		out[i] = result{ip: ip}
+	}
+	return out
+}
+
+func TestReorder(t *testing.T) {
+	// Batch 2 has no results and batch 5 is a short final batch.
+	batches := map[int][]result{
+		0: toResults(ips(3, 0)),
+		1: toResults(ips(3, 3)),
+		2: nil,
+		3: toResults(ips(3, 6)),
+		4: toResults(ips(3, 9)),
+		5: toResults(ips(1, 12)),
+	}
+	in := make(chan resultBatch, len(batches))
+	for _, seq := range []int{3, 0, 2, 5, 1, 4} {
+		in <- resultBatch{seq: seq, results: batches[seq]}
+	}
+	close(in)
+
+	var got []string
+	emitted, done := 0, 0
+	reorder(in, func(results []result) {
+		if !slices.Equal(results, batches[emitted]) {
+			t.Errorf("emit %d = %v, want batch %d", emitted, results, emitted)
+		}
+		emitted++
+		for _, r := range results {
+			got = append(got, r.ip)
+		}
+	}, func() { done++ })
+
+	if want := ips(13, 0); !slices.Equal(got, want) {
+		t.Errorf("emitted %v, want %v", got, want)
+	}
+	if done != len(batches) {
+		t.Errorf("done called %d times, want %d", done, len(batches))
+	}
+}
+
+// jitterLookup echoes its input after a random delay, so batches finish out
+// of order.
+func jitterLookup(ips []string) []result {
+	time.Sleep(time.Duration(rand.Intn(200)) * time.Microsecond)
+	return toResults(ips)
+}
+
+func TestProcessKeepsInputOrder(t *testing.T) {
+	const n, size = 200, 7
+	read := func(send func([]string)) {
+		for i := 0; i < n; i++ {
+			send(ips(size, i*size))
+		}
+		send(ips(3, n*size)) // partial final batch
+	}
+	want := ips(n*size+3, 0)
+
+	for _, unordered := range []bool{false, true} {
+		var got []string
+		process(read, 8, unordered, jitterLookup, func(results []result) {
+			for _, r := range results {
+				got = append(got, r.ip)
+			}
+		})
+		if !unordered && !slices.Equal(got, want) {
+			t.Errorf("ordered output is not in input order")
+		}
+		slices.SortFunc(got, func(a, b string) int {
+			x, _ := strconv.Atoi(a)
+			y, _ := strconv.Atoi(b)
+			return x - y
+		})
+		if !slices.Equal(got, want) {
+			t.Errorf("unordered=%v: got %d results, want every input once", unordered, len(got))
+		}
+	}
+}
+
+func TestProcessReadAhead(t *testing.T) {
+	const workers = 2
+	var sent atomic.Int32
+	first := make(chan struct{})
+	read := func(send func([]string)) {
+		for i := 0; i < 100; i++ {
+			send(ips(1, i))
+			sent.Add(1)
+		}
+	}
+	lookup := func(ips []string) []result {
+		if ips[0] == "0" {
+			<-first
+		}
+		return toResults(ips)
+	}
+
+	done := make(chan []string)
+	go func() {
+		var got []string
+		process(read, workers, false, lookup, func(results []result) {
+			for _, r := range results {
+				got = append(got, r.ip)
+			}
+		})
+		done <- got
+	}()
+
+	// While the first batch is stuck, reading stops once the window is full.
+	time.Sleep(50 * time.Millisecond)
+	if n := sent.Load(); n > workers*readAhead {
+		t.Errorf("read %d batches ahead of a stuck one, want at most %d", n, workers*readAhead)
+	}
+	close(first)
+	if got := <-done; !slices.Equal(got, ips(100, 0)) {
+		t.Errorf("emitted %v, want 0..99 in order", got)
+	}
+}
+
+// newClassifier returns a classifier over the embedded data with no groups
+// file, selecting providers if any are given.
+func newClassifier(t *testing.T, c classifier, providers ...string) *classifier {
+	t.Helper()
+	l, err := ip2cloud.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, err := store.ParseGroups(strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.lookup, c.groups = l, groups
+	if len(providers) > 0 {
+		c.providers = groups.Expand(providers)
+	}
+	return &c
+}
+
+func TestClassifierCheck(t *testing.T) {
+	for _, c := range []classifier{{}, {none: true}, {invert: true}, {invert: true, all: true}} {
+		if err := c.check(); err != nil {
+			t.Errorf("%+v: %v", c, err)
+		}
+	}
+	c := classifier{none: true, invert: true}
+	if err := c.check(); err == nil {
+		t.Error("-n with -x: got no error")
+	}
+}
+
+func TestClassify(t *testing.T) {
+	// 13.64.1.5 is in azure's 13.64.0.0/13 and microsoft's 13.64.0.0/11.
+	input := []string{"63.32.40.140", "13.64.1.5", "10.0.0.1", "bogus"}
+	tests := []struct {
+		name      string
+		flags     classifier
+		providers []string
+		want      []string
+	}{
+		{"default", classifier{}, nil, []string{
+			"[aws] 63.32.40.140", "[azure] 13.64.1.5", "invalid: bogus",
+		}},
+		{"none", classifier{none: true}, nil, []string{
+			"[aws] 63.32.40.140", "[azure] 13.64.1.5", "[none] 10.0.0.1", "invalid: bogus",
+		}},
+		{"invert", classifier{invert: true}, nil, []string{
+			"10.0.0.1", "invalid: bogus",
+		}},
+		{"invert all", classifier{invert: true, all: true}, nil, []string{
+			"10.0.0.1", "invalid: bogus",
+		}},
+		{"none all cidr", classifier{none: true, all: true, cidr: true}, nil, []string{
+			"[aws] 63.32.40.140 63.32.0.0/14",
+			"[azure] 13.64.1.5 13.64.0.0/13",
+			"[microsoft] 13.64.1.5 13.64.0.0/11",
+			"[none] 10.0.0.1",
+			"invalid: bogus",
+		}},
+		// -p alone filters the longest match only.
+		{"provider", classifier{}, []string{"microsoft"}, []string{
+			"invalid: bogus",
+		}},
+		// With -n and -x, a shorter range of a selected provider counts.
+		{"provider none", classifier{none: true}, []string{"microsoft"}, []string{
+			"[none] 63.32.40.140", "[microsoft] 13.64.1.5", "[none] 10.0.0.1", "invalid: bogus",
+		}},
+		{"provider none cidr", classifier{none: true, cidr: true}, []string{"microsoft"}, []string{
+			"[none] 63.32.40.140", "[microsoft] 13.64.1.5 13.64.0.0/11", "[none] 10.0.0.1", "invalid: bogus",
+		}},
+		{"provider invert", classifier{invert: true}, []string{"microsoft"}, []string{
+			"63.32.40.140", "10.0.0.1", "invalid: bogus",
+		}},
+		{"provider invert all", classifier{invert: true, all: true}, []string{"microsoft"}, []string{
+			"63.32.40.140", "10.0.0.1", "invalid: bogus",
+		}},
+		{"other provider invert", classifier{invert: true}, []string{"aws"}, []string{
+			"13.64.1.5", "10.0.0.1", "invalid: bogus",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newClassifier(t, tt.flags, tt.providers...)
+			var got []string
+			for _, r := range c.classify(input) {
+				if r.invalid {
+					got = append(got, "invalid: "+r.ip)
+				} else {
+					got = append(got, c.line(r))
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got  %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONGroups(t *testing.T) {
+	input := []string{"63.32.40.140", "10.0.0.1", "bogus"}
+	tests := []struct {
+		name  string
+		flags classifier
+		want  string
+	}{
+		{"default", classifier{}, `{"aws":["63.32.40.140"]}`},
+		{"none", classifier{none: true}, `{"aws":["63.32.40.140"],"invalid":["bogus"],"none":["10.0.0.1"]}`},
+		{"invert", classifier{invert: true}, `{"invalid":["bogus"],"none":["10.0.0.1"]}`},
+		{"invert cidr", classifier{invert: true, cidr: true}, `{"invalid":[{"ip":"bogus"}],"none":[{"ip":"10.0.0.1"}]}`},
+		{"none cidr", classifier{none: true, cidr: true}, `{"aws":[{"ip":"63.32.40.140","prefix":"63.32.0.0/14"}],"invalid":[{"ip":"bogus"}],"none":[{"ip":"10.0.0.1"}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newClassifier(t, tt.flags)
+			groups := newJSONGroups(c.cidr || c.meta)
+			for _, r := range c.classify(input) {
+				// Without -n or -x, invalid lines are reported on stderr.
+				if !r.invalid || c.invalidBucket(true) {
+					groups.add(r)
+				}
+			}
+			out, err := json.Marshal(groups.value())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("got  %s\nwant %s", out, tt.want)
+			}
+		})
+	}
+	if c := (classifier{none: true}); c.invalidBucket(false) {
+		t.Error("invalid lines get a bucket in text output")
+	}
+}
+
+func BenchmarkProcess(b *testing.B) {
+	l, err := ip2cloud.New()
+	if err != nil {
+		b.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(1))
+	input := make([][]string, 64)
+	for i := range input {
+		input[i] = make([]string, batchSize)
+		for j := range input[i] {
+			input[i][j] = fmt.Sprintf("%d.%d.%d.%d", r.Intn(256), r.Intn(256), r.Intn(256), r.Intn(256))
+		}
+	}
+	read := func(send func([]string)) {
+		for _, batch := range input {
+			send(batch)
+		}
+	}
+	lookup := func(ips []string) []result {
+		var results []result
+		for _, ip := range ips {
+			if p := l.ProviderString(ip); p != "" {
+				results = append(results, result{ip: ip, provider: p})
+			}
+		}
+		return results
+	}
+
+	for _, unordered := range []bool{false, true} {
+		name := "ordered"
+		if unordered {
+			name = "unordered"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				process(read, 4, unordered, lookup, func([]result) {})
+			}
+			b.ReportMetric(float64(b.N*len(input)*batchSize)/b.Elapsed().Seconds(), "ips/s")
+		})
+	}
+}
@@ -15,32 +15,59 @@ Usage:
   ip2cloud add <provider> ...   Add CIDR ranges to a provider
   ip2cloud remove <provider>    Remove a provider and its ranges
   ip2cloud list                 List providers and range counts
+  ip2cloud update [provider]    Refresh ranges from provider feeds
+  ip2cloud serve [flags]        Serve lookups over HTTP
   ip2cloud version              Print version
 
 Lookup Flags:
-  -p, -provider string   Only match specific providers (comma-separated, e.g., aws,azure)
+  -p, -provider string   Only match specific providers or groups (comma-separated, e.g., aws,azure)
   -j, -json              Print output in JSON format
+  -c, -cidr              Print the matched CIDR for each IP
+  -m, -meta              Print region/service metadata for each match
+  -a, -all               Print every overlapping provider, not only the longest match
   -w int                 Number of concurrent workers (default: NumCPU)
+  -u, -unordered         Print results as workers finish them instead of in input order
+  -n, -none              Also print IPs with no matching provider, labelled none
+  -x, -invert            Print only IPs with no matching provider (like grep -v)
 
 Build Flags:
   -seed string           Seed data from a directory of .txt files (default: embedded data)
+  -layout string         Trie layout: binary or poptrie (default: current layout, binary for a new trie)
+  -sign string           Sign the trie with an ed25519 private key (PEM file)
 
 Add Flags:
   -f string              Read CIDRs from a file (use '-' for stdin)
+  -format string         Format of the -f file: text, aws-json or azure-json (default: text)
+  -y                     Overwrite an existing provider without asking
+  -strict                Fail if any range is invalid instead of skipping it
   -build                 Rebuild binary trie after adding (default: true)
 
 Remove Flags:
   -build                 Rebuild binary trie after removing (default: true)
 
+Update Flags:
+  -build                 Rebuild binary trie after updating (default: true)
+  -timeout duration      Timeout for each provider feed (default: 1m)
+
+Serve Flags:
+  -addr string           Address to listen on (default: localhost:8080)
+  -watch duration        Reload when ip2cloud.bin changes, checking at this interval (default: 5s, 0 disables)
+
 Examples:
   cat ips.txt | ip2cloud              Lookup IPs from stdin
   ip2cloud 8.8.8.8 3.5.1.1            Lookup specific IPs
   ip2cloud -p aws < ips.txt           Only show AWS matches
   ip2cloud -j < ips.txt               Output as JSON
+  ip2cloud -c 3.5.1.1                 Show which CIDR matched
+  ip2cloud -a -c 13.64.1.5            Show every provider covering an IP
+  ip2cloud -x < ips.txt               Show only IPs outside every provider
   ip2cloud add mycloud 10.0.0.0/8     Add a CIDR range
   ip2cloud remove mycloud             Remove a provider
   ip2cloud list                       List all providers
+  ip2cloud update aws                 Refresh AWS ranges from ip-ranges.json
   ip2cloud build                      Rebuild trie from embedded data
+  ip2cloud build -sign ip2cloud.key   Rebuild and sign the trie
+  ip2cloud serve -addr :8080          Serve GET /lookup/{ip} and POST /lookup
 
 Run 'ip2cloud <command> -h' for command-specific help.
 `
@@ -60,6 +87,10 @@ func main() {
 		runRemove(os.Args[2:])
 	case "list":
 		runList()
+	case "update":
+		runUpdate(os.Args[2:])
+	case "serve":
+		runServe(os.Args[2:])
 	case "-v", "--version", "version":
 		fmt.Printf("ip2cloud version %s\n", version)
 	case "-h", "--help", "help":
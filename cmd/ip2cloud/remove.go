@@ -24,7 +24,10 @@ func runRemove(args []string) {
 		os.Exit(1)
 	}
 
-	provider := args[0]
+	provider, err := store.ParseProviderName(args[0])
+	if err != nil {
+		fatal("%v", err)
+	}
 
 	fs := flag.NewFlagSet("remove", flag.ExitOnError)
 	rebuild := fs.Bool("build", true, "Rebuild binary trie after removing")
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	ip2cloud "github.com/devanshbatham/ip2cloud"
+	"github.com/devanshbatham/ip2cloud/internal/server"
+	"github.com/devanshbatham/ip2cloud/internal/store"
+)
+
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8080", "Address to listen on")
+	watch := fs.Duration("watch", 5*time.Second, "Reload when ip2cloud.bin changes, checking at this interval (0 disables)")
+	fs.Parse(args)
+
+	s, err := store.DefaultStore()
+	if err != nil {
+		fatal("%v", err)
+	}
+
+	initial, err := ip2cloud.Default()
+	if err != nil {
+		fatal("loading trie: %v", err)
+	}
+	for _, w := range initial.Warnings() {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+	}
+	initial.Close()
+
+	reloader, err := ip2cloud.NewReloader(func() (*ip2cloud.Lookup, error) {
+		if len(s.TrustedKeys) > 0 {
+			return ip2cloud.LoadVerified(s.BinPath, s.TrustedKeys)
+		}
+		return ip2cloud.Load(s.BinPath)
+	})
+	if err != nil {
+		fatal("loading trie: %v", err)
+	}
+
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           server.New(reloader.Lookup),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logReload := func(err error) {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reload failed, keeping previous trie: %v\n", err)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Reloaded %s\n", s.BinPath)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				logReload(reloader.Reload())
+			}
+		}
+	}()
+
+	if *watch > 0 {
+		go reloader.WatchFile(ctx, s.BinPath, *watch, logReload)
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Fprintf(os.Stderr, "Listening on %s\n", *addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatal("serve: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/devanshbatham/ip2cloud/internal/feeds"
+	"github.com/devanshbatham/ip2cloud/internal/store"
+)
+
+func runUpdate(args []string) {
+	var names []string
+	for _, f := range feeds.Default() {
+		names = append(names, string(f.Provider))
+	}
+
+	fs := flag.NewFlagSet("update", flag.ExitOnError)
+	rebuild := fs.Bool("build", true, "Rebuild binary trie after updating")
+	timeout := fs.Duration("timeout", time.Minute, "Timeout for each provider feed")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: ip2cloud update [-build] [-timeout duration] [provider ...]\n\n")
+		fmt.Fprintf(os.Stderr, "Replace provider ranges with the lists each provider publishes.\n")
+		fmt.Fprintf(os.Stderr, "With no providers, every provider with a feed is updated.\n\n")
+		fmt.Fprintf(os.Stderr, "Providers: %s\n\n", strings.Join(names, ", "))
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		fmt.Fprintf(os.Stderr, "  -build             Rebuild binary trie after updating (default: true)\n")
+		fmt.Fprintf(os.Stderr, "  -timeout duration  Timeout for each provider feed (default: 1m)\n")
+	}
+	fs.Parse(args)
+
+	selected := feeds.Default()
+	if fs.NArg() > 0 {
+		selected = selected[:0:0]
+		for _, name := range fs.Args() {
+			f, ok := feeds.Find(strings.ToLower(name))
+			if !ok {
+				fatal("no feed for provider '%s' (available: %s)", name, strings.Join(names, ", "))
+			}
+			selected = append(selected, f)
+		}
+	}
+
+	s, err := store.DefaultStore()
+	if err != nil {
+		fatal("%v", err)
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	results := feeds.Update(context.Background(), s, client, selected)
+
+	updated, failed := 0, 0
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s: %v\n", r.Provider, r.Err)
+			failed++
+			continue
+		}
+		fmt.Printf("Updated %s with %d ranges\n", r.Provider, r.Ranges)
+		updated++
+	}
+
+	if *rebuild && updated > 0 {
+		if _, err := s.Build(); err != nil {
+			fatal("rebuild: %v", err)
+		}
+		fmt.Println("Rebuilt binary trie")
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
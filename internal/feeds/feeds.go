@@ -0,0 +1,446 @@
+// Package feeds downloads provider ranges from the lists each provider
+// publishes, so the data directory can be refreshed without a new release.
+package feeds
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/devanshbatham/ip2cloud/internal/store"
+	"github.com/devanshbatham/ip2cloud/internal/trie"
+)
+
+// maxBody caps the size of a single feed response. The largest feed, Azure's
+// ServiceTags file, is a few megabytes.
+const maxBody = 64 << 20
+
+// Feed describes where to download one provider's ranges and how to read
+// them.
+type Feed struct {
+	// Provider is the data file the ranges are written to.
+	Provider store.ProviderName
+	// URLs are fetched in order and their ranges combined. Tests and mirrors
+	// can point them elsewhere.
+	URLs []string
+
+	// link, if set, means each URL is a page linking to the real feed, which
+	// is found by matching link against the page body.
+	link  *regexp.Regexp
+	parse func(io.Reader) ([]string, error)
+}
+
+// Default returns the feeds for every provider with an official list.
+func Default() []Feed {
+	return []Feed{
+		{
+			Provider: "aws",
+			URLs:     []string{"https://ip-ranges.amazonaws.com/ip-ranges.json"},
+			parse:    parseAWS,
+		},
+		{
+			Provider: "azure",
+			URLs:     []string{"https://www.microsoft.com/en-us/download/details.aspx?id=56519"},
+			link:     regexp.MustCompile(`https?://[^"'\s]+/ServiceTags_Public_\d+\.json`),
+			parse:    parseAzure,
+		},
+		{
+			Provider: "cloudflare",
+			URLs:     []string{"https://www.cloudflare.com/ips-v4", "https://www.cloudflare.com/ips-v6"},
+			parse:    parseText,
+		},
+		{
+			Provider: "digitalocean",
+			URLs:     []string{"https://digitalocean.com/geo/google.csv"},
+			parse:    parseDigitalOcean,
+		},
+		{
+			Provider: "fastly",
+			URLs:     []string{"https://api.fastly.com/public-ip-list"},
+			parse:    parseFastly,
+		},
+		{
+			Provider: "github",
+			URLs:     []string{"https://api.github.com/meta"},
+			parse:    parseGitHub,
+		},
+		{
+			// goog.json covers all of Google; cloud.json adds the Cloud
+			// ranges customers can use.
+			Provider: "google",
+			URLs:     []string{"https://www.gstatic.com/ipranges/goog.json", "https://www.gstatic.com/ipranges/cloud.json"},
+			parse:    parseGoogle,
+		},
+		{
+			Provider: "oracle",
+			URLs:     []string{"https://docs.oracle.com/en-us/iaas/tools/public_ip_ranges.json"},
+			parse:    parseOracle,
+		},
+	}
+}
+
+// Find returns the default feed for provider.
+func Find(provider string) (Feed, bool) {
+	for _, f := range Default() {
+		if string(f.Provider) == provider {
+			return f, true
+		}
+	}
+	return Feed{}, false
+}
+
+// Fetch downloads and parses the feed, returning its ranges without
+// duplicates. It fails rather than return an empty list, so a broken feed
+// never wipes out a provider.
+func (f Feed) Fetch(ctx context.Context, client *http.Client) ([]string, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	seen := make(map[string]bool)
+	var ranges []string
+	for _, url := range f.URLs {
+		if f.link != nil {
+			page, err := get(ctx, client, url)
+			if err != nil {
+				return nil, err
+			}
+			link := f.link.Find(page)
+			if link == nil {
+				return nil, fmt.Errorf("%s: no feed link found", url)
+			}
+			url = string(link)
+		}
+		body, err := get(ctx, client, url)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := f.parse(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", url, err)
+		}
+		if ranges, err = appendRanges(ranges, seen, parsed); err != nil {
+			return nil, fmt.Errorf("%s: %w", url, err)
+		}
+	}
+	if len(ranges) == 0 {
+		return nil, errors.New("feed returned no ranges")
+	}
+	return ranges, nil
+}
+
+// appendRanges checks each parsed line and appends it to ranges in
+// canonical form, skipping lines already in seen.
+func appendRanges(ranges []string, seen map[string]bool, parsed []string) ([]string, error) {
+	for _, line := range parsed {
+		line, err := trie.NormalizeRange(line)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[line] {
+			seen[line] = true
+			ranges = append(ranges, line)
+		}
+	}
+	return ranges, nil
+}
+
+// formats maps the names accepted by Import to their parsers.
+var formats = map[string]func(io.Reader) ([]string, error){
+	"aws-json":   parseAWS,
+	"azure-json": parseAzure,
+}
+
+// Formats returns the names of the file formats Import understands.
+func Formats() []string {
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Import reads a provider's published range file in the named format, such
+// as an AWS ip-ranges.json, and returns its ranges with metadata in the
+// data file syntax.
+func Import(format string, r io.Reader) ([]string, error) {
+	parse, ok := formats[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown format %q (available: %s)", format, strings.Join(Formats(), ", "))
+	}
+	parsed, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+	ranges, err := appendRanges(nil, make(map[string]bool), parsed)
+	if err != nil {
+		return nil, err
+	}
+	if len(ranges) == 0 {
+		return nil, errors.New("no ranges found")
+	}
+	return ranges, nil
+}
+
+func get(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "ip2cloud")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBody+1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", url, err)
+	}
+	if len(body) > maxBody {
+		return nil, fmt.Errorf("%s: response larger than %d bytes", url, maxBody)
+	}
+	return body, nil
+}
+
+// Result reports the outcome of updating one provider.
+type Result struct {
+	Provider store.ProviderName
+	Ranges   int
+	Err      error
+}
+
+// Update fetches each feed and overwrites the provider's data file with the
+// ranges it returns. A failed feed leaves its provider untouched and does
+// not stop the others. The caller rebuilds the trie afterwards.
+func Update(ctx context.Context, s *store.Store, client *http.Client, feeds []Feed) []Result {
+	results := make([]Result, len(feeds))
+	for i, f := range feeds {
+		results[i].Provider = f.Provider
+		ranges, err := f.Fetch(ctx, client)
+		if err == nil {
+			err = s.OverwriteRanges(f.Provider, ranges)
+		}
+		results[i].Ranges = len(ranges)
+		results[i].Err = err
+	}
+	return results
+}
+
+type awsPrefix struct {
+	IPPrefix           string `json:"ip_prefix"`
+	IPv6Prefix         string `json:"ipv6_prefix"`
+	Region             string `json:"region"`
+	Service            string `json:"service"`
+	NetworkBorderGroup string `json:"network_border_group"`
+}
+
+// parseAWS reads ip-ranges.json. Most prefixes are listed once under the
+// AMAZON umbrella service and again under the service that uses them, so
+// AMAZON entries are emitted first and the specific service wins lookups.
+func parseAWS(r io.Reader) ([]string, error) {
+	var doc struct {
+		Prefixes     []awsPrefix `json:"prefixes"`
+		IPv6Prefixes []awsPrefix `json:"ipv6_prefixes"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	prefixes := append(doc.Prefixes, doc.IPv6Prefixes...)
+	sort.SliceStable(prefixes, func(i, j int) bool {
+		return prefixes[i].Service == "AMAZON" && prefixes[j].Service != "AMAZON"
+	})
+	ranges := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		m := trie.Meta{Region: p.Region, Service: p.Service, Source: "ip-ranges.json"}
+		if p.NetworkBorderGroup != p.Region {
+			m.Zone = p.NetworkBorderGroup
+		}
+		ranges = append(ranges, strings.TrimSpace(p.IPPrefix+p.IPv6Prefix+" "+m.Format()))
+	}
+	return ranges, nil
+}
+
+// parseAzure reads a ServiceTags_Public JSON file. Tags are named after a
+// service, optionally split by region ("Storage.EastUS"). Only a tag with
+// a region is such a split; other dotted names ("AzureFrontDoor.Backend")
+// are services of their own. The regional split carries the region, so a prefix is only taken from the aggregate
+// tag when no regional tag of the same service lists it. AzureCloud covers
+// the whole platform and becomes region-only metadata emitted ahead of the
+// services, so the specific service wins lookups.
+func parseAzure(r io.Reader) ([]string, error) {
+	var doc struct {
+		Values []struct {
+			Name       string `json:"name"`
+			Properties struct {
+				Region          string   `json:"region"`
+				AddressPrefixes []string `json:"addressPrefixes"`
+			} `json:"properties"`
+		} `json:"values"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	type entry struct {
+		prefix string
+		meta   trie.Meta
+	}
+	regional := make(map[[2]string]bool)
+	var platform, services []entry
+	for pass := 0; pass < 2; pass++ {
+		for _, v := range doc.Values {
+			split := v.Properties.Region != ""
+			if split != (pass == 0) {
+				continue
+			}
+			service := v.Name
+			if split {
+				service, _, _ = strings.Cut(v.Name, ".")
+			}
+			m := trie.Meta{Region: v.Properties.Region, Service: service, Source: "ServiceTags"}
+			out := &services
+			if service == "AzureCloud" {
+				m.Service = ""
+				out = &platform
+			}
+			for _, p := range v.Properties.AddressPrefixes {
+				key := [2]string{service, p}
+				if split {
+					regional[key] = true
+				} else if regional[key] {
+					continue
+				}
+				*out = append(*out, entry{p, m})
+			}
+		}
+	}
+
+	ranges := make([]string, 0, len(platform)+len(services))
+	for _, e := range append(platform, services...) {
+		ranges = append(ranges, e.prefix+" "+e.meta.Format())
+	}
+	return ranges, nil
+}
+
+// parseGoogle reads the goog.json and cloud.json format.
+func parseGoogle(r io.Reader) ([]string, error) {
+	var doc struct {
+		Prefixes []struct {
+			IPv4Prefix string `json:"ipv4Prefix"`
+			IPv6Prefix string `json:"ipv6Prefix"`
+		} `json:"prefixes"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	var ranges []string
+	for _, p := range doc.Prefixes {
+		for _, v := range []string{p.IPv4Prefix, p.IPv6Prefix} {
+			if v != "" {
+				ranges = append(ranges, v)
+			}
+		}
+	}
+	return ranges, nil
+}
+
+func parseOracle(r io.Reader) ([]string, error) {
+	var doc struct {
+		Regions []struct {
+			CIDRs []struct {
+				CIDR string `json:"cidr"`
+			} `json:"cidrs"`
+		} `json:"regions"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	var ranges []string
+	for _, region := range doc.Regions {
+		for _, c := range region.CIDRs {
+			ranges = append(ranges, c.CIDR)
+		}
+	}
+	return ranges, nil
+}
+
+func parseFastly(r io.Reader) ([]string, error) {
+	var doc struct {
+		Addresses     []string `json:"addresses"`
+		IPv6Addresses []string `json:"ipv6_addresses"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	return append(doc.Addresses, doc.IPv6Addresses...), nil
+}
+
+// githubServices are the keys of the GitHub meta API that list GitHub's own
+// ranges. Actions and Codespaces run on Azure and are left to the azure
+// provider.
+var githubServices = []string{"hooks", "web", "api", "git", "packages", "pages", "importer"}
+
+func parseGitHub(r io.Reader) ([]string, error) {
+	var doc map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	var ranges []string
+	for _, key := range githubServices {
+		raw, ok := doc[key]
+		if !ok {
+			continue
+		}
+		var list []string
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		ranges = append(ranges, list...)
+	}
+	return ranges, nil
+}
+
+// parseDigitalOcean reads the geofeed CSV: cidr,country,region,city,zip.
+func parseDigitalOcean(r io.Reader) ([]string, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.Comment = '#'
+	var ranges []string
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return ranges, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if cidr := strings.TrimSpace(rec[0]); cidr != "" {
+			ranges = append(ranges, cidr)
+		}
+	}
+}
+
+// parseText reads one CIDR per line.
+func parseText(r io.Reader) ([]string, error) {
+	var ranges []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" {
+			ranges = append(ranges, line)
+		}
+	}
+	return ranges, sc.Err()
+}
@@ -0,0 +1,235 @@
+package feeds
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/devanshbatham/ip2cloud/internal/store"
+	"github.com/devanshbatham/ip2cloud/internal/trie"
+)
+
+// fixtures maps the path of each default feed URL to a trimmed-down copy of
+// what the provider serves.
+var fixtures = map[string]string{
+	"/ip-ranges.json":                            awsRanges,
+	"/en-us/download/details.aspx":               `<a href="{{server}}/download/ServiceTags_Public_20261012.json">Download</a>`,
+	"/download/ServiceTags_Public_20261012.json": azureTags,
+	"/ips-v4":              "173.245.48.0/20\n103.21.244.0/22\n",
+	"/ips-v6":              "2400:cb00::/32\n",
+	"/geo/google.csv":      "5.101.96.0/21,NL,NL-NH,Amsterdam,1098\n2a03:b0c0::/32,NL,NL-NH,Amsterdam,\n",
+	"/public-ip-list":      `{"addresses":["23.235.32.0/20"],"ipv6_addresses":["2a04:4e40::/32"]}`,
+	"/meta":                `{"verifiable_password_authentication":false,"web":["140.82.112.0/20"],"api":["140.82.112.0/20","192.30.252.0/22"],"actions":["4.148.0.0/16"]}`,
+	"/ipranges/goog.json":  `{"prefixes":[{"ipv4Prefix":"8.8.4.0/24"},{"ipv6Prefix":"2001:4860::/32"}]}`,
+	"/ipranges/cloud.json": `{"prefixes":[{"ipv4Prefix":"34.80.0.0/15","service":"Google Cloud","scope":"asia-east1"}]}`,
+	"/en-us/iaas/tools/public_ip_ranges.json": `{"regions":[{"region":"us-phoenix-1","cidrs":[{"cidr":"129.146.0.0/21","tags":["OCI"]}]}]}`,
+}
+
+const awsRanges = `{"syncToken":"1","prefixes":[
+	{"ip_prefix":"3.5.140.0/22","region":"ap-northeast-2","service":"S3","network_border_group":"ap-northeast-2"},
+	{"ip_prefix":"3.5.140.0/22","region":"ap-northeast-2","service":"AMAZON","network_border_group":"ap-northeast-2"},
+	{"ip_prefix":"15.181.232.0/21","region":"us-east-1","service":"EC2","network_border_group":"us-east-1-iah-1"}],
+	"ipv6_prefixes":[{"ipv6_prefix":"2600:1f18::/36","region":"us-east-1","service":"EC2","network_border_group":"us-east-1"}]}`
+
+var awsLines = []string{
+	"3.5.140.0/22 region=ap-northeast-2 service=AMAZON source=ip-ranges.json",
+	"3.5.140.0/22 region=ap-northeast-2 service=S3 source=ip-ranges.json",
+	"15.181.232.0/21 region=us-east-1 zone=us-east-1-iah-1 service=EC2 source=ip-ranges.json",
+	"2600:1f18::/36 region=us-east-1 service=EC2 source=ip-ranges.json",
+}
+
+const azureTags = `{"changeNumber":1,"cloud":"Public","values":[
+	{"name":"AzureCloud","properties":{"region":"","addressPrefixes":["13.64.0.0/16","20.38.98.0/24","2603:1030::/40"]}},
+	{"name":"AzureCloud.eastus","properties":{"region":"eastus","addressPrefixes":["13.64.0.0/16","2603:1030::/40"]}},
+	{"name":"Storage","properties":{"region":"","systemService":"AzureStorage","addressPrefixes":["13.64.0.0/16","20.38.98.0/24"]}},
+	{"name":"Storage.EastUS","properties":{"region":"eastus","systemService":"AzureStorage","addressPrefixes":["13.64.0.0/16"]}},
+	{"name":"AzureFrontDoor.Frontend","properties":{"region":"","addressPrefixes":["13.107.246.0/24"]}},
+	{"name":"AzureFrontDoor.Backend","properties":{"region":"","addressPrefixes":["147.243.0.0/16"]}}]}`
+
+var azureLines = []string{
+	"13.64.0.0/16 region=eastus source=ServiceTags",
+	"2603:1030::/40 region=eastus source=ServiceTags",
+	"20.38.98.0/24 source=ServiceTags",
+	"13.64.0.0/16 region=eastus service=Storage source=ServiceTags",
+	"20.38.98.0/24 service=Storage source=ServiceTags",
+	"13.107.246.0/24 service=AzureFrontDoor.Frontend source=ServiceTags",
+	"147.243.0.0/16 service=AzureFrontDoor.Backend source=ServiceTags",
+}
+
+// testFeeds returns the default feeds pointed at a local server.
+func testFeeds(t *testing.T) []Feed {
+	t.Helper()
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := fixtures[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(strings.ReplaceAll(body, "{{server}}", ts.URL)))
+	}))
+	t.Cleanup(ts.Close)
+
+	feeds := Default()
+	for i := range feeds {
+		for j, u := range feeds[i].URLs {
+			parsed, err := url.Parse(u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			feeds[i].URLs[j] = ts.URL + parsed.RequestURI()
+		}
+	}
+	return feeds
+}
+
+func TestFetch(t *testing.T) {
+	want := map[store.ProviderName][]string{
+		"aws":          awsLines,
+		"azure":        azureLines,
+		"cloudflare":   {"173.245.48.0/20", "103.21.244.0/22", "2400:cb00::/32"},
+		"digitalocean": {"5.101.96.0/21", "2a03:b0c0::/32"},
+		"fastly":       {"23.235.32.0/20", "2a04:4e40::/32"},
+		"github":       {"140.82.112.0/20", "192.30.252.0/22"},
+		"google":       {"8.8.4.0/24", "2001:4860::/32", "34.80.0.0/15"},
+		"oracle":       {"129.146.0.0/21"},
+	}
+
+	feeds := testFeeds(t)
+	if len(feeds) != len(want) {
+		t.Fatalf("got %d default feeds, want %d", len(feeds), len(want))
+	}
+	for _, f := range feeds {
+		got, err := f.Fetch(context.Background(), nil)
+		if err != nil {
+			t.Errorf("%s: %v", f.Provider, err)
+			continue
+		}
+		if !slices.Equal(got, want[f.Provider]) {
+			t.Errorf("%s: got %v, want %v", f.Provider, got, want[f.Provider])
+		}
+	}
+}
+
+func TestFetchErrors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/empty":
+			w.Write([]byte(`{"prefixes":[]}`))
+		case "/bad":
+			w.Write([]byte(`{"prefixes":[{"ip_prefix":"not-a-cidr"}]}`))
+		default:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	for _, path := range []string{"/empty", "/bad", "/down"} {
+		f, _ := Find("aws")
+		f.URLs = []string{ts.URL + path}
+		if ranges, err := f.Fetch(context.Background(), nil); err == nil {
+			t.Errorf("%s: expected error, got %v", path, ranges)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	tmp := t.TempDir()
+	s := &store.Store{
+		DataDir: filepath.Join(tmp, "data"),
+		BinPath: filepath.Join(tmp, "ip2cloud.bin"),
+	}
+	if err := s.AddRanges("aws", []string{"1.2.3.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddRanges("fastly", []string{"23.235.32.0/20"}); err != nil {
+		t.Fatal(err)
+	}
+
+	feeds := testFeeds(t)
+	aws, fastly := feeds[0], feeds[4]
+	fastly.URLs = []string{fastly.URLs[0] + "-missing"}
+
+	results := Update(context.Background(), s, nil, []Feed{aws, fastly})
+	if results[0].Err != nil || results[0].Ranges != len(awsLines) {
+		t.Errorf("aws result = %+v, want %d ranges", results[0], len(awsLines))
+	}
+	if results[1].Err == nil {
+		t.Errorf("fastly: expected error for missing feed")
+	}
+
+	got, err := s.ReadProviderRanges("aws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, awsLines) {
+		t.Errorf("aws ranges = %v, want %v", got, awsLines)
+	}
+	got, err = s.ReadProviderRanges("fastly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"23.235.32.0/20"}; !slices.Equal(got, want) {
+		t.Errorf("fastly ranges = %v, want %v (failed feed must not overwrite)", got, want)
+	}
+}
+
+func TestImportAWS(t *testing.T) {
+	got, err := Import("aws-json", strings.NewReader(awsRanges))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, awsLines) {
+		t.Errorf("got %v, want %v", got, awsLines)
+	}
+
+	// The umbrella AMAZON entry goes first so the specific service wins.
+	tr := trie.Build(map[string][]string{"aws": got})
+	m, ok := tr.LookupMatch("3.5.140.1")
+	if !ok || m.Meta.Service != "S3" {
+		t.Errorf("LookupMatch(3.5.140.1) = %+v, want service S3", m)
+	}
+	if all := tr.LookupAll("3.5.140.1"); len(all) != 2 {
+		t.Errorf("LookupAll(3.5.140.1) = %+v, want 2 matches", all)
+	}
+
+	if _, err := Import("aws-json", strings.NewReader(`{"prefixes":[]}`)); err == nil {
+		t.Error("expected error for a file without ranges")
+	}
+	if _, err := Import("bogus", strings.NewReader(awsRanges)); err == nil {
+		t.Error("expected error for unknown format")
+	}
+}
+
+func TestImportAzure(t *testing.T) {
+	got, err := Import("azure-json", strings.NewReader(azureTags))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, azureLines) {
+		t.Errorf("got %v, want %v", got, azureLines)
+	}
+
+	tr := trie.Build(map[string][]string{"azure": got})
+	cases := []struct {
+		ip   string
+		want trie.Meta
+	}{
+		{"13.64.1.1", trie.Meta{Region: "eastus", Service: "Storage", Source: "ServiceTags"}},
+		{"2603:1030::1", trie.Meta{Region: "eastus", Source: "ServiceTags"}},
+		{"20.38.98.1", trie.Meta{Service: "Storage", Source: "ServiceTags"}},
+		{"13.107.246.1", trie.Meta{Service: "AzureFrontDoor.Frontend", Source: "ServiceTags"}},
+		{"147.243.0.1", trie.Meta{Service: "AzureFrontDoor.Backend", Source: "ServiceTags"}},
+	}
+	for _, c := range cases {
+		m, ok := tr.LookupMatch(c.ip)
+		if !ok || m.Meta != c.want {
+			t.Errorf("LookupMatch(%s) = %+v, want %+v", c.ip, m.Meta, c.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	ip2cloud "github.com/devanshbatham/ip2cloud"
+)
+
+const (
+	maxBodyBytes = 8 << 20
+	maxBatchSize = 100000
+)
+
+type Result struct {
+	IP       string `json:"ip"`
+	Provider string `json:"provider"`
+	Prefix   string `json:"prefix,omitempty"`
+	Region   string `json:"region,omitempty"`
+	Zone     string `json:"zone,omitempty"`
+	Service  string `json:"service,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type Server struct {
+	current func() *ip2cloud.Lookup
+	mux     *http.ServeMux
+}
+
+func New(current func() *ip2cloud.Lookup) *Server {
+	s := &Server{current: current, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/lookup/", s.handleLookupOne)
+	s.mux.HandleFunc("/lookup", s.handleLookupBatch)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) handleLookupOne(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	ip := strings.TrimPrefix(r.URL.Path, "/lookup/")
+	res := resolve(s.current(), ip)
+	if res.Error != "" {
+		writeError(w, http.StatusBadRequest, res.Error)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) handleLookupBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var ips []string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(&ips); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("request body must be a JSON array of IP strings: %v", err))
+		return
+	}
+	if len(ips) > maxBatchSize {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("at most %d IPs per request", maxBatchSize))
+		return
+	}
+	l := s.current()
+	results := make([]Result, len(ips))
+	for i, ip := range ips {
+		results[i] = resolve(l, ip)
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func resolve(l *ip2cloud.Lookup, ip string) Result {
+	ip = strings.TrimSpace(ip)
+	res := Result{IP: ip}
+	addr, err := ip2cloud.ParseAddr(ip)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	if m, ok := l.Match(addr); ok {
+		res.Provider = m.Provider
+		res.Prefix = m.Prefix.String()
+		res.Region = m.Region
+		res.Zone = m.Zone
+		res.Service = m.Service
+	}
+	return res
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ip2cloud "github.com/devanshbatham/ip2cloud"
+	"github.com/devanshbatham/ip2cloud/internal/store"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	tmp := t.TempDir()
+	s := &store.Store{
+		DataDir: filepath.Join(tmp, "data"),
+		BinPath: filepath.Join(tmp, "ip2cloud.bin"),
+	}
+	if err := s.AddRanges("aws", []string{"52.94.0.0/22 region=us-east-1 service=EC2", "2600:1f18::/36"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Build(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := ip2cloud.Open(s.BinPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	ts := httptest.NewServer(New(func() *ip2cloud.Lookup { return l }))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestLookupOne(t *testing.T) {
+	ts := newTestServer(t)
+
+	cases := []struct {
+		ip     string
+		status int
+		want   Result
+	}{
+		{"52.94.1.1", http.StatusOK, Result{IP: "52.94.1.1", Provider: "aws", Prefix: "52.94.0.0/22", Region: "us-east-1", Service: "EC2"}},
+		{"2600:1f18::1", http.StatusOK, Result{IP: "2600:1f18::1", Provider: "aws", Prefix: "2600:1f18::/36"}},
+		{"10.0.0.1", http.StatusOK, Result{IP: "10.0.0.1"}},
+	}
+	for _, c := range cases {
+		resp, err := http.Get(ts.URL + "/lookup/" + c.ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Result
+		json.NewDecoder(resp.Body).Decode(&got)
+		resp.Body.Close()
+		if resp.StatusCode != c.status || got != c.want {
+			t.Errorf("GET /lookup/%s = %d %+v, want %d %+v", c.ip, resp.StatusCode, got, c.status, c.want)
+		}
+	}
+
+	resp, err := http.Get(ts.URL + "/lookup/not-an-ip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET /lookup/not-an-ip status = %d, want 400", resp.StatusCode)
+	}
+
+	resp, err = http.Post(ts.URL+"/lookup/52.94.1.1", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST /lookup/52.94.1.1 status = %d, want 405", resp.StatusCode)
+	}
+}
+
+func TestLookupBatch(t *testing.T) {
+	ts := newTestServer(t)
+
+	body := `["52.94.1.1", "10.0.0.1", "bogus", "2600:1f18::1"]`
+	resp, err := http.Post(ts.URL+"/lookup", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	var got []Result
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 4 {
+		t.Fatalf("got %d results, want 4", len(got))
+	}
+	if got[0].Provider != "aws" || got[0].Prefix != "52.94.0.0/22" {
+		t.Errorf("results[0] = %+v", got[0])
+	}
+	if got[1].Provider != "" || got[1].Error != "" {
+		t.Errorf("results[1] = %+v", got[1])
+	}
+	if got[2].Error == "" {
+		t.Errorf("results[2] = %+v, want an error", got[2])
+	}
+	if got[3].Provider != "aws" {
+		t.Errorf("results[3] = %+v", got[3])
+	}
+
+	for _, bad := range []string{`{"ip": "1.2.3.4"}`, `not json`} {
+		resp, err := http.Post(ts.URL+"/lookup", "application/json", strings.NewReader(bad))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("POST %s status = %d, want 400", bad, resp.StatusCode)
+		}
+	}
+
+	resp, err = http.Get(ts.URL + "/lookup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET /lookup status = %d, want 405", resp.StatusCode)
+	}
+}
@@ -0,0 +1,147 @@
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Groups holds the provider groups and aliases from the groups file. Each
+// non-comment line is one of
+//
+//	group <name> <provider or group>...
+//	alias <name> <provider>
+//
+// A group lets a filter name several providers at once. An alias reports a
+// provider under another name, so a duplicate data file or a familiar
+// short name collapses into one provider.
+type Groups struct {
+	groups  map[string][]string
+	aliases map[string]string
+}
+
+// GroupsPath returns the groups file, which sits next to the data dir so
+// it is not read as a provider.
+func (s *Store) GroupsPath() string {
+	return filepath.Join(filepath.Dir(s.DataDir), "groups.txt")
+}
+
+// LoadGroups reads the groups file. A missing file yields empty Groups.
+func (s *Store) LoadGroups() (*Groups, error) {
+	f, err := os.Open(s.GroupsPath())
+	if os.IsNotExist(err) {
+		return ParseGroups(strings.NewReader(""))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	g, err := ParseGroups(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.GroupsPath(), err)
+	}
+	return g, nil
+}
+
+// ParseGroups reads groups and aliases in the groups file format.
+func ParseGroups(r io.Reader) (*Groups, error) {
+	g := &Groups{groups: make(map[string][]string), aliases: make(map[string]string)}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(strings.ToLower(line))
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "group":
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("line %d: group needs a name and at least one member", n)
+			}
+			g.groups[fields[1]] = append(g.groups[fields[1]], fields[2:]...)
+		case "alias":
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("line %d: alias needs a name and one provider", n)
+			}
+			if fields[1] == fields[2] {
+				return nil, fmt.Errorf("line %d: %s is an alias of itself", n, fields[1])
+			}
+			g.aliases[fields[1]] = fields[2]
+		default:
+			return nil, fmt.Errorf("line %d: unknown directive %q", n, fields[0])
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Canonical returns the name provider is reported under. Aliases apply to
+// hierarchical names too, so with "alias cloudlare cloudflare" the provider
+// "cloudlare/cdn" becomes "cloudflare/cdn".
+func (g *Groups) Canonical(provider string) string {
+	for seen := 0; seen <= len(g.aliases); seen++ {
+		name := provider
+		for {
+			if target, ok := g.aliases[name]; ok {
+				provider = target + provider[len(name):]
+				break
+			}
+			i := strings.LastIndexByte(name, '/')
+			if i < 0 {
+				return provider
+			}
+			name = name[:i]
+		}
+	}
+	return provider
+}
+
+// Expand replaces each group in names with its members, recursively, and
+// returns the canonical provider names without duplicates.
+func (g *Groups) Expand(names []string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	added := make(map[string]bool)
+	var expand func(name string)
+	expand = func(name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		if members, ok := g.groups[name]; ok {
+			for _, m := range members {
+				expand(m)
+			}
+			return
+		}
+		if c := g.Canonical(name); !added[c] {
+			added[c] = true
+			out = append(out, c)
+		}
+	}
+	for _, name := range names {
+		expand(strings.ToLower(name))
+	}
+	return out
+}
+
+// GroupNames returns the defined groups in sorted order.
+func (g *Groups) GroupNames() []string {
+	names := make([]string, 0, len(g.groups))
+	for name := range g.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Members returns the members of group as written in the groups file.
+func (g *Groups) Members(group string) []string {
+	return g.groups[group]
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// TrustedKeysPath returns the file of public keys that ip2cloud.bin must be
+// signed with. Verification is required while the file exists.
+func (s *Store) TrustedKeysPath() string {
+	return filepath.Join(filepath.Dir(s.DataDir), "trusted_keys.pem")
+}
+
+// LoadTrustedKeys reads the trusted keys file. A missing file yields no
+// keys.
+func (s *Store) LoadTrustedKeys() ([]ed25519.PublicKey, error) {
+	data, err := os.ReadFile(s.TrustedKeysPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	keys, err := ParsePublicKeys(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.TrustedKeysPath(), err)
+	}
+	return keys, nil
+}
+
+// ParsePublicKeys reads the ed25519 keys in PEM "PUBLIC KEY" blocks, as
+// written by "openssl pkey -pubout". At least one key is required.
+func ParsePublicKeys(data []byte) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+		}
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := pub.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("public key is %T, not ed25519", pub)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no PEM public keys found")
+	}
+	return keys, nil
+}
+
+// ReadPrivateKey reads an ed25519 key from a PEM "PRIVATE KEY" file, as
+// written by "openssl genpkey -algorithm ed25519".
+func ReadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: no PEM private key found", path)
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	key, ok := priv.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: private key is %T, not ed25519", path, priv)
+	}
+	return key, nil
+}
@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package store
+
+import "os"
+
+// lockFile is a no-op where flock is unavailable. Writes are still atomic,
+// but concurrent ip2cloud processes are not serialized.
+func lockFile(f *os.File) error {
+	return nil
+}
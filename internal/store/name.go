@@ -0,0 +1,56 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxNameSegment limits each "/"-separated part of a provider name.
+const maxNameSegment = 64
+
+// ProviderName is a provider name that is safe to turn into a path under
+// the data dir. It is one or more segments separated by "/"; each segment
+// starts with a letter or digit and otherwise holds only letters, digits,
+// ".", "_" and "-". That rules out "..", absolute paths, backslashes and
+// empty segments.
+//
+// Store methods validate their ProviderName argument again, so a name
+// converted directly from a string is still checked.
+type ProviderName string
+
+// ParseProviderName validates s as a provider name.
+func ParseProviderName(s string) (ProviderName, error) {
+	n := ProviderName(s)
+	if err := n.Validate(); err != nil {
+		return "", err
+	}
+	return n, nil
+}
+
+// Validate reports why n is not a valid provider name, or nil.
+func (n ProviderName) Validate() error {
+	if n == "" {
+		return fmt.Errorf("empty provider name")
+	}
+	for _, seg := range strings.Split(string(n), "/") {
+		if seg == "" {
+			return fmt.Errorf("invalid provider name %q: empty path segment", string(n))
+		}
+		if len(seg) > maxNameSegment {
+			return fmt.Errorf("invalid provider name %q: segment longer than %d characters", string(n), maxNameSegment)
+		}
+		if !isAlnum(seg[0]) {
+			return fmt.Errorf("invalid provider name %q: segment %q must start with a letter or digit", string(n), seg)
+		}
+		for i := 1; i < len(seg); i++ {
+			if c := seg[i]; !isAlnum(c) && c != '.' && c != '_' && c != '-' {
+				return fmt.Errorf("invalid provider name %q: character %q not allowed", string(n), c)
+			}
+		}
+	}
+	return nil
+}
+
+func isAlnum(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
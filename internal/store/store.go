@@ -2,103 +2,157 @@ package store
 
 import (
 	"bufio"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
 
+	"github.com/devanshbatham/ip2cloud/internal/atomicfile"
 	"github.com/devanshbatham/ip2cloud/internal/trie"
 )
 
 type Store struct {
 	DataDir string
 	BinPath string
+	// Layout, if set, is the layout Build writes. Otherwise rebuilds keep
+	// the layout of the existing trie, and a new trie uses the binary one.
+	Layout *trie.Layout
+	// SigningKey, if set, signs every trie the store builds.
+	SigningKey ed25519.PrivateKey
+	// TrustedKeys, if set, makes LoadTrie and LoadOrBuildTrie refuse a trie
+	// that is not signed by one of them.
+	TrustedKeys []ed25519.PublicKey
 }
 
+// DefaultStore returns the store in the user's config directory, with
+// TrustedKeys read from its trusted keys file.
 func DefaultStore() (*Store, error) {
 	configDir, err := os.UserConfigDir()
 	if err != nil {
 		return nil, err
 	}
 	base := filepath.Join(configDir, "ip2cloud")
-	return &Store{
+	s := &Store{
 		DataDir: filepath.Join(base, "data"),
 		BinPath: filepath.Join(base, "ip2cloud.bin"),
-	}, nil
+	}
+	if s.TrustedKeys, err = s.LoadTrustedKeys(); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
 func (s *Store) Init() error {
 	return os.MkdirAll(s.DataDir, 0755)
 }
 
-func (s *Store) ReadProviderRanges(provider string) ([]string, error) {
-	path := filepath.Join(s.DataDir, provider+".txt")
+// providerPath returns the data file for provider. Hierarchical names such
+// as "aws/ec2/us-east-1" live in nested directories under DataDir.
+func (s *Store) providerPath(provider ProviderName) (string, error) {
+	if err := provider.Validate(); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.DataDir, filepath.FromSlash(string(provider))+".txt"), nil
+}
+
+func (s *Store) ReadProviderRanges(provider ProviderName) ([]string, error) {
+	path, err := s.providerPath(provider)
+	if err != nil {
+		return nil, err
+	}
 	return readLines(path)
 }
 
-func (s *Store) ProviderExists(provider string) bool {
-	path := filepath.Join(s.DataDir, provider+".txt")
-	_, err := os.Stat(path)
+func (s *Store) ProviderExists(provider ProviderName) bool {
+	path, err := s.providerPath(provider)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
 	return err == nil
 }
 
-func (s *Store) AddRanges(provider string, cidrs []string) error {
-	if err := s.Init(); err != nil {
+// AddRanges appends cidrs to the provider's data file, creating it if
+// needed. Like every write to the store, the file is replaced atomically
+// while holding the store lock.
+func (s *Store) AddRanges(provider ProviderName, cidrs []string) error {
+	path, err := s.providerPath(provider)
+	if err != nil {
 		return err
 	}
-	path := filepath.Join(s.DataDir, provider+".txt")
-	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	unlock, err := s.lock()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	w := bufio.NewWriter(f)
-	for _, cidr := range cidrs {
-		w.WriteString(cidr)
-		w.WriteByte('\n')
+	defer unlock()
+	existing, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
 	}
-	return w.Flush()
+	if len(existing) > 0 && existing[len(existing)-1] != '\n' {
+		existing = append(existing, '\n')
+	}
+	return writeRanges(path, existing, cidrs)
 }
 
-func (s *Store) OverwriteRanges(provider string, cidrs []string) error {
-	if err := s.Init(); err != nil {
+func (s *Store) OverwriteRanges(provider ProviderName, cidrs []string) error {
+	path, err := s.providerPath(provider)
+	if err != nil {
 		return err
 	}
-	path := filepath.Join(s.DataDir, provider+".txt")
-	f, err := os.OpenFile(path, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	unlock, err := s.lock()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	w := bufio.NewWriter(f)
-	for _, cidr := range cidrs {
-		w.WriteString(cidr)
-		w.WriteByte('\n')
+	defer unlock()
+	return writeRanges(path, nil, cidrs)
+}
+
+func writeRanges(path string, existing []byte, cidrs []string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
 	}
-	return w.Flush()
+	return atomicfile.WriteFile(path, 0644, func(w io.Writer) error {
+		if _, err := w.Write(existing); err != nil {
+			return err
+		}
+		for _, cidr := range cidrs {
+			if _, err := io.WriteString(w, cidr+"\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 func (s *Store) ListProviders() ([]ProviderInfo, error) {
-	entries, err := os.ReadDir(s.DataDir)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil
-		}
-		return nil, err
+	if _, err := os.Stat(s.DataDir); os.IsNotExist(err) {
+		return nil, nil
 	}
 	var result []ProviderInfo
-	for _, e := range entries {
-		if e.IsDir() || !strings.HasSuffix(e.Name(), ".txt") {
-			continue
-		}
-		name := strings.TrimSuffix(e.Name(), ".txt")
-		ranges, err := readLines(filepath.Join(s.DataDir, e.Name()))
+	err := walkProviders(os.DirFS(s.DataDir), func(name, path string) error {
+		ranges, err := readLines(filepath.Join(s.DataDir, filepath.FromSlash(path)))
 		if err != nil {
-			continue
+			return nil
 		}
-		result = append(result, ProviderInfo{Name: name, RangeCount: len(ranges)})
+		count := 0
+		for _, line := range ranges {
+			if _, _, err := trie.ParseRange(line); err == nil {
+				count++
+			}
+		}
+		result = append(result, ProviderInfo{Name: name, RangeCount: count})
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	sort.Slice(result, func(i, j int) bool {
 		return result[i].Name < result[j].Name
@@ -107,76 +161,305 @@ func (s *Store) ListProviders() ([]ProviderInfo, error) {
 }
 
 type ProviderInfo struct {
-	Name       string
+	Name string
+	// RangeCount counts valid ranges only, not comments, section headers
+	// or lines Build would warn about.
 	RangeCount int
 }
 
-func (s *Store) RemoveProvider(provider string) error {
-	path := filepath.Join(s.DataDir, provider+".txt")
+// RemoveProvider deletes the provider's data file along with any parent
+// directories it leaves empty. Child providers are kept.
+func (s *Store) RemoveProvider(provider ProviderName) error {
+	path, err := s.providerPath(provider)
+	if err != nil {
+		return err
+	}
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return fmt.Errorf("provider '%s' not found", provider)
 	}
-	return os.Remove(path)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	for dir := filepath.Dir(path); dir != filepath.Clean(s.DataDir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
 }
 
+// Build reads the data dir and writes the trie to BinPath.
 func (s *Store) Build() (*trie.Trie, error) {
-	entries, err := os.ReadDir(s.DataDir)
+	unlock, err := s.lock()
 	if err != nil {
-		return nil, fmt.Errorf("reading data dir: %w", err)
+		return nil, err
 	}
+	defer unlock()
+	return s.build(s.layout())
+}
 
-	cloudData := make(map[string][]string)
-	for _, e := range entries {
-		if e.IsDir() || !strings.HasSuffix(e.Name(), ".txt") {
-			continue
-		}
-		name := strings.TrimSuffix(e.Name(), ".txt")
-		ranges, err := readLines(filepath.Join(s.DataDir, e.Name()))
-		if err != nil {
-			return nil, fmt.Errorf("reading %s: %w", e.Name(), err)
-		}
-		cloudData[name] = ranges
+// layout returns the layout to build with: Layout if set, otherwise that of
+// the trie at BinPath, or binary if it cannot be read.
+func (s *Store) layout() trie.Layout {
+	if s.Layout != nil {
+		return *s.Layout
+	}
+	t, err := trie.Open(s.BinPath)
+	if err != nil {
+		return trie.LayoutBinary
+	}
+	defer t.Close()
+	return t.Layout()
+}
+
+func (s *Store) build(layout trie.Layout) (*trie.Trie, error) {
+	fingerprint, err := Fingerprint(os.DirFS(s.DataDir))
+	if err != nil {
+		return nil, err
+	}
+	cloudData, err := ReadRanges(os.DirFS(s.DataDir))
+	if err != nil {
+		return nil, err
 	}
 
 	t := trie.Build(cloudData)
+	t.Fingerprint = fingerprint
+	if layout == trie.LayoutPoptrie {
+		t.Compile()
+	}
+	if s.SigningKey != nil {
+		t.Sign(s.SigningKey)
+	}
 	if err := t.Save(s.BinPath); err != nil {
 		return nil, fmt.Errorf("saving binary trie: %w", err)
 	}
 	return t, nil
 }
 
+// LoadTrie opens the trie at BinPath, verifying its signature when
+// TrustedKeys is set.
 func (s *Store) LoadTrie() (*trie.Trie, error) {
-	return trie.Load(s.BinPath)
+	if len(s.TrustedKeys) > 0 {
+		return trie.OpenVerified(s.BinPath, s.TrustedKeys)
+	}
+	return trie.Open(s.BinPath)
 }
 
+// LoadOrBuildTrie opens the trie at BinPath, building it from the data dir
+// when it is missing, corrupt or older than the data dir. seedFS fills the
+// data dir first if it has no provider files. A rebuild that replaces an
+// existing file is reported in the new trie's Warnings.
+//
+// When TrustedKeys is set the trie is only rebuilt if the store has a
+// SigningKey, since a trie built here would not be trusted. Without one a
+// missing or untrusted file is an error, and a trie older than the data dir
+// is returned with a warning.
 func (s *Store) LoadOrBuildTrie(seedFS fs.FS) (*trie.Trie, error) {
-	t, err := trie.Load(s.BinPath)
-	if err == nil {
+	t, err := s.LoadTrie()
+	if err == nil && !s.stale(t) {
 		return t, nil
 	}
+	if len(s.TrustedKeys) > 0 && s.SigningKey == nil {
+		if err != nil {
+			return nil, fmt.Errorf("%w (not rebuilding: trusted keys are configured and no signing key is set)", err)
+		}
+		t.Warnings = append(t.Warnings, fmt.Sprintf("%s has changed since %s was built; not rebuilding because trusted keys are configured", s.DataDir, s.BinPath))
+		return t, nil
+	}
+	if err == nil {
+		t.Close()
+	}
 	if err := s.Init(); err != nil {
 		return nil, fmt.Errorf("creating data dir: %w", err)
 	}
-	if err := s.SeedFromFS(seedFS); err != nil {
-		return nil, fmt.Errorf("seeding data: %w", err)
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// Another process may have built the trie while this one waited.
+	t, err = s.LoadTrie()
+	if err == nil && !s.stale(t) {
+		return t, nil
+	}
+	layout, warning := s.layout(), ""
+	if err == nil {
+		t.Close()
+		warning = fmt.Sprintf("%s has changed since %s was built, rebuilt", s.DataDir, s.BinPath)
+	} else {
+		if errors.Is(err, trie.ErrCorrupt) {
+			warning = fmt.Sprintf("%s: %v, rebuilt from %s", s.BinPath, err, s.DataDir)
+		}
+		// Seed only an empty data dir: provider files missing from one
+		// in use were removed on purpose.
+		if !s.hasProviders() {
+			if err := s.copyFS(seedFS, false); err != nil {
+				return nil, fmt.Errorf("seeding data: %w", err)
+			}
+		}
+	}
+	t, err = s.build(layout)
+	if err != nil {
+		return nil, err
+	}
+	if warning != "" {
+		t.Warnings = append(t.Warnings, warning)
+	}
+	return t, nil
+}
+
+// hasProviders reports whether the data dir has any provider files.
+func (s *Store) hasProviders() bool {
+	found := false
+	walkProviders(os.DirFS(s.DataDir), func(name, path string) error {
+		found = true
+		return fs.SkipAll
+	})
+	return found
+}
+
+// stale reports whether the data dir no longer matches the files t was
+// built from. A trie without a fingerprint, or a store without a data dir,
+// is never stale.
+func (s *Store) stale(t *trie.Trie) bool {
+	if t.Fingerprint == ([32]byte{}) {
+		return false
+	}
+	if _, err := os.Stat(s.DataDir); err != nil {
+		return false
 	}
-	return s.Build()
+	fingerprint, err := Fingerprint(os.DirFS(s.DataDir))
+	return err == nil && fingerprint != t.Fingerprint
 }
 
+// SeedFromFS copies the .txt files in seedFS into the data dir, keeping any
+// provider file that already exists.
 func (s *Store) SeedFromFS(seedFS fs.FS) error {
-	return fs.WalkDir(seedFS, ".", func(path string, d fs.DirEntry, err error) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return s.copyFS(seedFS, false)
+}
+
+// SeedFromDir copies the .txt files under dir into the data dir, replacing
+// provider files that already exist.
+func (s *Store) SeedFromDir(dir string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return s.copyFS(os.DirFS(dir), true)
+}
+
+func (s *Store) copyFS(fsys fs.FS, overwrite bool) error {
+	return fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil || d.IsDir() || !strings.HasSuffix(d.Name(), ".txt") {
 			return err
 		}
-		src, err := fs.ReadFile(seedFS, path)
+		dst := filepath.Join(s.DataDir, filepath.FromSlash(path))
+		if _, err := os.Stat(dst); err == nil && !overwrite {
+			return nil
+		}
+		src, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		return atomicfile.WriteFile(dst, 0644, func(w io.Writer) error {
+			_, err := w.Write(src)
+			return err
+		})
+	})
+}
+
+// lock takes the store's exclusive lock, waiting while another ip2cloud
+// process changes the data dir or the trie. Calling the returned function
+// releases it.
+func (s *Store) lock() (func(), error) {
+	path := filepath.Join(filepath.Dir(s.DataDir), "ip2cloud.lock")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("locking %s: %w", path, err)
+	}
+	return func() { f.Close() }, nil
+}
+
+// ReadRanges reads every provider data file in fsys, keyed by provider
+// name. Files in subdirectories become hierarchical providers, so
+// aws/ec2/us-east-1.txt is read as "aws/ec2/us-east-1".
+func ReadRanges(fsys fs.FS) (map[string][]string, error) {
+	cloudData := make(map[string][]string)
+	err := walkProviders(fsys, func(name, path string) error {
+		f, err := fsys.Open(path)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+		ranges, err := ScanRanges(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+		cloudData[name] = ranges
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cloudData, nil
+}
+
+// Fingerprint hashes the name, size and contents of every provider data
+// file in fsys. Any edit, addition or removal changes it.
+func Fingerprint(fsys fs.FS) ([32]byte, error) {
+	h := sha256.New()
+	err := walkProviders(fsys, func(name, path string) error {
+		data, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		fmt.Fprintf(h, "%s\x00%d\x00", path, len(data))
+		h.Write(sum[:])
+		return nil
+	})
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return [32]byte(h.Sum(nil)), nil
+}
+
+// walkProviders calls fn with the provider name and slash-separated path of
+// each .txt file in fsys.
+func walkProviders(fsys fs.FS, fn func(name, path string) error) error {
+	return fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
+			if path == "." {
+				return fmt.Errorf("reading data dir: %w", err)
+			}
 			return err
 		}
-		dst := filepath.Join(s.DataDir, d.Name())
-		if _, err := os.Stat(dst); err == nil {
+		if d.IsDir() || !strings.HasSuffix(path, ".txt") {
 			return nil
 		}
-		return os.WriteFile(dst, src, 0644)
+		return fn(strings.TrimSuffix(path, ".txt"), path)
 	})
 }
 
@@ -186,11 +469,23 @@ func readLines(path string) ([]string, error) {
 		return nil, err
 	}
 	defer f.Close()
+	return ScanRanges(f)
+}
+
+// sectionHeader matches lines such as "IPv4:" that some published lists
+// use to separate address families.
+var sectionHeader = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9 _-]*:$`)
+
+// ScanRanges reads ranges in the data file format: one range per line,
+// with "#" starting a comment that runs to the end of the line. Blank
+// lines and section headers are skipped.
+func ScanRanges(r io.Reader) ([]string, error) {
 	var lines []string
-	sc := bufio.NewScanner(f)
+	sc := bufio.NewScanner(r)
 	for sc.Scan() {
-		line := strings.TrimSpace(sc.Text())
-		if line != "" {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line != "" && !sectionHeader.MatchString(line) {
 			lines = append(lines, line)
 		}
 	}
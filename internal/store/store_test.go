@@ -1,10 +1,21 @@
 package store
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"testing/fstest"
+
+	"github.com/devanshbatham/ip2cloud/internal/trie"
 )
 
 func TestAddAndBuildRoundTrip(t *testing.T) {
@@ -124,3 +135,575 @@ func TestSeedFromFSWritesMissing(t *testing.T) {
 		t.Errorf("expected aws.txt to exist: %v", err)
 	}
 }
+
+func TestBuildPreservesMetadata(t *testing.T) {
+	tmp := t.TempDir()
+	s := &Store{
+		DataDir: filepath.Join(tmp, "data"),
+		BinPath: filepath.Join(tmp, "ip2cloud.bin"),
+	}
+
+	if err := s.AddRanges("aws", []string{"52.94.0.0/22 region=us-east-1 service=EC2", "3.0.0.0/8"}); err != nil {
+		t.Fatalf("AddRanges: %v", err)
+	}
+	if _, err := s.Build(); err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+
+	tr, err := s.LoadTrie()
+	if err != nil {
+		t.Fatalf("LoadTrie: %v", err)
+	}
+
+	m, ok := tr.LookupMatch("52.94.1.1")
+	if !ok || m.Provider != "aws" || m.Meta.String() != "us-east-1 EC2" {
+		t.Errorf("LookupMatch(52.94.1.1) = %+v, %v", m, ok)
+	}
+	if got := tr.Lookup("3.1.1.1"); got != "aws" {
+		t.Errorf("Lookup(3.1.1.1) = %q, want %q", got, "aws")
+	}
+}
+
+func TestBuildPoptrieLayout(t *testing.T) {
+	tmp := t.TempDir()
+	s := &Store{
+		DataDir: filepath.Join(tmp, "data"),
+		BinPath: filepath.Join(tmp, "ip2cloud.bin"),
+		Layout:  ptr(trie.LayoutPoptrie),
+	}
+
+	if err := s.AddRanges("testprov", []string{"10.0.0.0/8", "2001:db8::/32"}); err != nil {
+		t.Fatalf("AddRanges: %v", err)
+	}
+	if _, err := s.Build(); err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+
+	tr, err := s.LoadTrie()
+	if err != nil {
+		t.Fatalf("LoadTrie: %v", err)
+	}
+	if tr.Layout() != trie.LayoutPoptrie {
+		t.Errorf("Layout() = %v, want poptrie", tr.Layout())
+	}
+	for _, ip := range []string{"10.0.0.1", "2001:db8::1"} {
+		if got := tr.Lookup(ip); got != "testprov" {
+			t.Errorf("Lookup(%s) = %q, want %q", ip, got, "testprov")
+		}
+	}
+	tr.Close()
+
+	// Rebuilds without an explicit layout, as after add, remove or update,
+	// keep the layout of the existing trie.
+	steps := []struct {
+		layout *trie.Layout
+		want   trie.Layout
+	}{
+		{nil, trie.LayoutPoptrie},
+		{ptr(trie.LayoutBinary), trie.LayoutBinary},
+		{nil, trie.LayoutBinary},
+	}
+	for i, step := range steps {
+		s.Layout = step.layout
+		if err := s.AddRanges("other", []string{fmt.Sprintf("192.0.%d.0/24", i)}); err != nil {
+			t.Fatal(err)
+		}
+		built, err := s.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if built.Layout() != step.want {
+			t.Errorf("step %d: layout = %v, want %v", i, built.Layout(), step.want)
+		}
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestHierarchicalProviders(t *testing.T) {
+	tmp := t.TempDir()
+	s := &Store{
+		DataDir: filepath.Join(tmp, "data"),
+		BinPath: filepath.Join(tmp, "ip2cloud.bin"),
+	}
+
+	if err := s.AddRanges("aws", []string{"3.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddRanges("aws/ec2/us-east-1", []string{"3.5.0.0/16", "3.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(s.DataDir, "aws", "ec2", "us-east-1.txt")); err != nil {
+		t.Fatalf("expected nested data file: %v", err)
+	}
+
+	providers, err := s.ListProviders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(providers) != 2 || providers[0].Name != "aws" || providers[1].Name != "aws/ec2/us-east-1" {
+		t.Errorf("ListProviders() = %+v", providers)
+	}
+
+	tr, err := s.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tr.Lookup("3.5.1.1"); got != "aws/ec2/us-east-1" {
+		t.Errorf("Lookup(3.5.1.1) = %q, want %q", got, "aws/ec2/us-east-1")
+	}
+	if len(tr.Conflicts) != 0 {
+		t.Errorf("a child repeating its parent's prefix is not a conflict: %+v", tr.Conflicts)
+	}
+
+	if err := s.RemoveProvider("aws/ec2/us-east-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(s.DataDir, "aws")); !os.IsNotExist(err) {
+		t.Errorf("expected empty provider directories to be removed, got %v", err)
+	}
+	if !s.ProviderExists("aws") {
+		t.Error("removing a child removed its parent")
+	}
+}
+
+func TestGroups(t *testing.T) {
+	g, err := ParseGroups(strings.NewReader(`
+# comment
+group hyperscalers aws azure gcp
+group big hyperscalers cloudflare  # nested group
+alias cloudlare cloudflare
+alias gcp google
+`))
+	if err != nil {
+		t.Fatalf("ParseGroups: %v", err)
+	}
+
+	for provider, want := range map[string]string{
+		"cloudlare":     "cloudflare",
+		"cloudlare/cdn": "cloudflare/cdn",
+		"gcp":           "google",
+		"aws":           "aws",
+		"cloudlarex":    "cloudlarex",
+	} {
+		if got := g.Canonical(provider); got != want {
+			t.Errorf("Canonical(%q) = %q, want %q", provider, got, want)
+		}
+	}
+
+	got := g.Expand([]string{"Big", "cloudlare", "aws/ec2"})
+	want := []string{"aws", "azure", "google", "cloudflare", "aws/ec2"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Expand = %v, want %v", got, want)
+	}
+	if names := g.GroupNames(); !slices.Equal(names, []string{"big", "hyperscalers"}) {
+		t.Errorf("GroupNames() = %v", names)
+	}
+
+	for _, bad := range []string{"group onlyname", "alias a", "alias a a", "nonsense x y"} {
+		if _, err := ParseGroups(strings.NewReader(bad)); err == nil {
+			t.Errorf("ParseGroups(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestLoadGroups(t *testing.T) {
+	tmp := t.TempDir()
+	s := &Store{
+		DataDir: filepath.Join(tmp, "data"),
+		BinPath: filepath.Join(tmp, "ip2cloud.bin"),
+	}
+
+	g, err := s.LoadGroups()
+	if err != nil {
+		t.Fatalf("LoadGroups without a file: %v", err)
+	}
+	if got := g.Canonical("aws"); got != "aws" {
+		t.Errorf("Canonical(aws) = %q with no groups file", got)
+	}
+
+	if err := os.WriteFile(s.GroupsPath(), []byte("alias aliyun alibaba\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	g, err = s.LoadGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := g.Canonical("aliyun"); got != "alibaba" {
+		t.Errorf("Canonical(aliyun) = %q, want alibaba", got)
+	}
+}
+
+func TestCommentsAndSectionHeaders(t *testing.T) {
+	tmp := t.TempDir()
+	s := &Store{
+		DataDir: filepath.Join(tmp, "data"),
+		BinPath: filepath.Join(tmp, "ip2cloud.bin"),
+	}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	data := `# Cloudflare ranges
+IPv4:
+173.245.48.0/20   # San Jose
+103.21.244.0/22 region=global #no space
+
+IPv6:
+2400:cb00::/32
+`
+	if err := os.WriteFile(filepath.Join(s.DataDir, "cloudflare.txt"), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"173.245.48.0/20", "103.21.244.0/22 region=global", "2400:cb00::/32"}
+	got, err := s.ReadProviderRanges("cloudflare")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("ReadProviderRanges = %q, want %q", got, want)
+	}
+
+	providers, err := s.ListProviders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(providers) != 1 || providers[0].RangeCount != 3 {
+		t.Errorf("ListProviders() = %+v, want cloudflare with 3 ranges", providers)
+	}
+
+	tr, err := s.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.Warnings) != 0 {
+		t.Errorf("unexpected warnings: %v", tr.Warnings)
+	}
+	for _, ip := range []string{"173.245.48.1", "103.21.244.1", "2400:cb00::1"} {
+		if got := tr.Lookup(ip); got != "cloudflare" {
+			t.Errorf("Lookup(%s) = %q, want cloudflare", ip, got)
+		}
+	}
+}
+
+func TestProviderName(t *testing.T) {
+	for _, name := range []string{"aws", "aws/ec2/us-east-1", "apple-icloud-relay", "my_cloud.v2", "Azure"} {
+		if _, err := ParseProviderName(name); err != nil {
+			t.Errorf("ParseProviderName(%q): %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "..", "../evil", "aws/../../evil", "/etc/passwd", "aws/", "aws//ec2", `aws\ec2`, ".hidden", "a b", "aws/-x", strings.Repeat("a", 65)} {
+		if _, err := ParseProviderName(name); err == nil {
+			t.Errorf("ParseProviderName(%q) succeeded, want error", name)
+		}
+	}
+}
+
+func TestStoreRejectsInvalidProviderNames(t *testing.T) {
+	tmp := t.TempDir()
+	s := &Store{
+		DataDir: filepath.Join(tmp, "data"),
+		BinPath: filepath.Join(tmp, "ip2cloud.bin"),
+	}
+	evil := ProviderName("../evil")
+
+	if err := s.AddRanges(evil, []string{"10.0.0.0/8"}); err == nil {
+		t.Error("AddRanges accepted a path traversal name")
+	}
+	if err := s.OverwriteRanges(evil, []string{"10.0.0.0/8"}); err == nil {
+		t.Error("OverwriteRanges accepted a path traversal name")
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "evil.txt")); !os.IsNotExist(err) {
+		t.Errorf("file written outside the data dir: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(tmp, "evil.txt"), []byte("10.0.0.0/8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if s.ProviderExists(evil) {
+		t.Error("ProviderExists reported a file outside the data dir")
+	}
+	if _, err := s.ReadProviderRanges(evil); err == nil {
+		t.Error("ReadProviderRanges read a file outside the data dir")
+	}
+	if err := s.RemoveProvider(evil); err == nil {
+		t.Error("RemoveProvider accepted a path traversal name")
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "evil.txt")); err != nil {
+		t.Errorf("file outside the data dir was removed: %v", err)
+	}
+}
+
+func TestConcurrentAddRanges(t *testing.T) {
+	tmp := t.TempDir()
+	s := &Store{
+		DataDir: filepath.Join(tmp, "data"),
+		BinPath: filepath.Join(tmp, "ip2cloud.bin"),
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := s.AddRanges("aws", []string{fmt.Sprintf("10.%d.0.0/16", i)}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	ranges, err := s.ReadProviderRanges("aws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 20 {
+		t.Errorf("got %d ranges after 20 concurrent appends, want 20", len(ranges))
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "ip2cloud.lock")); err != nil {
+		t.Errorf("expected lock file next to the data dir: %v", err)
+	}
+}
+
+func TestRebuildKeepsOpenTrieIntact(t *testing.T) {
+	tmp := t.TempDir()
+	s := &Store{
+		DataDir: filepath.Join(tmp, "data"),
+		BinPath: filepath.Join(tmp, "ip2cloud.bin"),
+	}
+	if err := s.AddRanges("old", []string{"10.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Build(); err != nil {
+		t.Fatal(err)
+	}
+	old, err := s.LoadTrie()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+
+	if err := s.RemoveProvider("old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddRanges("new", []string{"10.0.0.0/8", "2001:db8::/32"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := old.Lookup("10.1.1.1"); got != "old" {
+		t.Errorf("previously opened trie: Lookup = %q, want old", got)
+	}
+	cur, err := s.LoadTrie()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cur.Close()
+	if got := cur.Lookup("10.1.1.1"); got != "new" {
+		t.Errorf("rebuilt trie: Lookup = %q, want new", got)
+	}
+}
+
+func TestLoadOrBuildTrieRebuildsCorruptFile(t *testing.T) {
+	tmp := t.TempDir()
+	s := &Store{
+		DataDir: filepath.Join(tmp, "data"),
+		BinPath: filepath.Join(tmp, "ip2cloud.bin"),
+	}
+	if err := s.AddRanges("testprov", []string{"10.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddRanges("removed", []string{"192.0.2.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RemoveProvider("removed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Build(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(s.BinPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A provider removed before the damage must not come back from the
+	// seed data.
+	seed := fstest.MapFS{
+		"testprov.txt": {Data: []byte("10.0.0.0/8\n")},
+		"removed.txt":  {Data: []byte("192.0.2.0/24\n")},
+	}
+	for name, damaged := range map[string][]byte{
+		"checksum mismatch": append(bytes.Clone(data[:len(data)-1]), data[len(data)-1]^0xff),
+		"file too short":    data[:10],
+	} {
+		if err := os.WriteFile(s.BinPath, damaged, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.LoadTrie(); !errors.Is(err, trie.ErrCorrupt) {
+			t.Fatalf("%s: LoadTrie: err = %v, want ErrCorrupt", name, err)
+		}
+
+		tr, err := s.LoadOrBuildTrie(seed)
+		if err != nil {
+			t.Fatalf("%s: LoadOrBuildTrie: %v", name, err)
+		}
+		if got := tr.Lookup("10.1.1.1"); got != "testprov" {
+			t.Errorf("%s: Lookup(10.1.1.1) = %q, want testprov", name, got)
+		}
+		if got := tr.Lookup("192.0.2.1"); got != "" {
+			t.Errorf("%s: Lookup(192.0.2.1) = %q, want empty: a removed provider was seeded again", name, got)
+		}
+		if len(tr.Warnings) != 1 || !strings.Contains(tr.Warnings[0], name) {
+			t.Errorf("%s: Warnings = %q, want one reporting it", name, tr.Warnings)
+		}
+		tr.Close()
+		if _, err := s.LoadTrie(); err != nil {
+			t.Errorf("%s: LoadTrie after rebuild: %v", name, err)
+		}
+	}
+}
+
+func TestTrustedKeys(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp := t.TempDir()
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(tmp, "ip2cloud.key")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	der, err = x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Store{
+		DataDir: filepath.Join(tmp, "data"),
+		BinPath: filepath.Join(tmp, "ip2cloud.bin"),
+	}
+	if err := os.WriteFile(s.TrustedKeysPath(), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if s.TrustedKeys, err = s.LoadTrustedKeys(); err != nil || len(s.TrustedKeys) != 1 || !s.TrustedKeys[0].Equal(pub) {
+		t.Fatalf("LoadTrustedKeys = %v, %v", s.TrustedKeys, err)
+	}
+	if s.SigningKey, err = ReadPrivateKey(keyPath); err != nil || !s.SigningKey.Equal(priv) {
+		t.Fatalf("ReadPrivateKey = %v", err)
+	}
+	if err := s.AddRanges("testprov", []string{"10.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// An unsigned trie is refused, and without a signing key it is not
+	// replaced by one built here.
+	signer := s.SigningKey
+	s.SigningKey = nil
+	if _, err := s.Build(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.LoadTrie(); !errors.Is(err, trie.ErrUnsigned) {
+		t.Fatalf("LoadTrie of unsigned trie: err = %v, want ErrUnsigned", err)
+	}
+	if _, err := s.LoadOrBuildTrie(fstest.MapFS{}); !errors.Is(err, trie.ErrUnsigned) {
+		t.Fatalf("LoadOrBuildTrie without signing key: err = %v, want ErrUnsigned", err)
+	}
+
+	s.SigningKey = signer
+	tr, err := s.LoadOrBuildTrie(fstest.MapFS{})
+	if err != nil {
+		t.Fatalf("LoadOrBuildTrie with signing key: %v", err)
+	}
+	tr.Close()
+	tr, err = s.LoadTrie()
+	if err != nil {
+		t.Fatalf("LoadTrie of signed trie: %v", err)
+	}
+	defer tr.Close()
+	if got := tr.Lookup("10.1.1.1"); got != "testprov" {
+		t.Errorf("Lookup = %q, want testprov", got)
+	}
+}
+
+func TestLoadOrBuildTrieRebuildsStaleTrie(t *testing.T) {
+	tmp := t.TempDir()
+	s := &Store{
+		DataDir: filepath.Join(tmp, "data"),
+		BinPath: filepath.Join(tmp, "ip2cloud.bin"),
+		Layout:  ptr(trie.LayoutPoptrie),
+	}
+	if err := s.AddRanges("first", []string{"10.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Build(); err != nil {
+		t.Fatal(err)
+	}
+	s.Layout = nil
+
+	tr, err := s.LoadOrBuildTrie(fstest.MapFS{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.Warnings) != 0 {
+		t.Errorf("unchanged data dir: Warnings = %q", tr.Warnings)
+	}
+	tr.Close()
+
+	// Hand-edit a data file the way the README suggests.
+	if err := os.WriteFile(filepath.Join(s.DataDir, "first.txt"), []byte("10.0.0.0/8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(s.DataDir, "second.txt"), []byte("192.0.2.0/24\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tr, err = s.LoadOrBuildTrie(fstest.MapFS{"seeded.txt": {Data: []byte("198.51.100.0/24\n")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	if got := tr.Lookup("192.0.2.1"); got != "second" {
+		t.Errorf("Lookup(192.0.2.1) = %q, want second", got)
+	}
+	if got := tr.Lookup("198.51.100.1"); got != "" {
+		t.Errorf("Lookup(198.51.100.1) = %q, want empty: a stale rebuild must not seed", got)
+	}
+	if len(tr.Warnings) != 1 || !strings.Contains(tr.Warnings[0], "has changed") {
+		t.Errorf("Warnings = %q, want one about the changed data dir", tr.Warnings)
+	}
+	if tr.Layout() != trie.LayoutPoptrie {
+		t.Errorf("rebuilt layout = %s, want poptrie", tr.Layout())
+	}
+
+	// With trusted keys and no signing key, a stale trie is kept.
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.TrustedKeys, s.SigningKey = []ed25519.PublicKey{pub}, priv
+	if _, err := s.Build(); err != nil {
+		t.Fatal(err)
+	}
+	s.SigningKey = nil
+	if err := s.RemoveProvider("second"); err != nil {
+		t.Fatal(err)
+	}
+	kept, err := s.LoadOrBuildTrie(fstest.MapFS{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kept.Close()
+	if got := kept.Lookup("192.0.2.1"); got != "second" {
+		t.Errorf("signed trie: Lookup(192.0.2.1) = %q, want second", got)
+	}
+	if len(kept.Warnings) != 1 || !strings.Contains(kept.Warnings[0], "not rebuilding") {
+		t.Errorf("signed trie: Warnings = %q, want one saying it was not rebuilt", kept.Warnings)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"math/rand"
+	"path/filepath"
 	"testing"
 )
 
@@ -14,6 +15,13 @@ func loadEmbeddedTrie(b *testing.B) *Trie {
 	return Build(data)
 }
 
+func loadEmbeddedPoptrie(b *testing.B) *Trie {
+	b.Helper()
+	tr := loadEmbeddedTrie(b)
+	tr.Compile()
+	return tr
+}
+
 func generateRealisticData() map[string][]string {
 	return map[string][]string{
 		"aws": {
@@ -211,6 +219,40 @@ func BenchmarkSerializeRoundTrip(b *testing.B) {
 	}
 }
 
+func BenchmarkLoadFile(b *testing.B) {
+	path := saveEmbeddedTrie(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr, err := Load(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		tr.Lookup("52.1.2.3")
+	}
+}
+
+func BenchmarkOpenMapped(b *testing.B) {
+	path := saveEmbeddedTrie(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr, err := Open(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		tr.Lookup("52.1.2.3")
+		tr.Close()
+	}
+}
+
+func saveEmbeddedTrie(b *testing.B) string {
+	b.Helper()
+	path := filepath.Join(b.TempDir(), "ip2cloud.bin")
+	if err := loadEmbeddedTrie(b).Save(path); err != nil {
+		b.Fatal(err)
+	}
+	return path
+}
+
 func BenchmarkParseIPv4Valid(b *testing.B) {
 	ips := []string{"192.168.1.100", "10.0.0.1", "255.255.255.255", "0.0.0.0"}
 	b.ResetTimer()
@@ -278,3 +320,57 @@ func BenchmarkBulkLookup(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkLayouts(b *testing.B) {
+	hits := []string{
+		"52.1.2.3", "34.100.50.25", "20.40.50.60",
+		"104.16.5.100", "68.183.10.20", "35.200.1.1",
+	}
+	rng := rand.New(rand.NewSource(42))
+	random := make([]uint32, 10000)
+	for i := range random {
+		random[i] = rng.Uint32()
+	}
+
+	layouts := []struct {
+		name string
+		load func(*testing.B) *Trie
+	}{
+		{"binary", loadEmbeddedTrie},
+		{"poptrie", loadEmbeddedPoptrie},
+	}
+	for _, l := range layouts {
+		b.Run(l.name+"/Hit", func(b *testing.B) {
+			tr := l.load(b)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tr.Lookup(hits[i%len(hits)])
+			}
+		})
+		b.Run(l.name+"/RawRandom", func(b *testing.B) {
+			tr := l.load(b)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tr.lookupRaw(random[i%len(random)])
+			}
+		})
+		b.Run(l.name+"/FileSize", func(b *testing.B) {
+			tr := l.load(b)
+			var buf bytes.Buffer
+			tr.Encode(&buf)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tr.Lookup("52.1.2.3")
+			}
+			b.ReportMetric(float64(buf.Len()), "file-bytes")
+		})
+	}
+}
+
+func BenchmarkCompilePoptrie(b *testing.B) {
+	data := generateRealisticData()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Build(data).Compile()
+	}
+}
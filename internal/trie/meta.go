@@ -0,0 +1,93 @@
+package trie
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+type Meta struct {
+	Region string
+	// Zone narrows Region when the provider publishes a finer location,
+	// such as an AWS network border group for a Local Zone.
+	Zone    string
+	Service string
+	Source  string
+}
+
+func (m Meta) IsZero() bool {
+	return m == Meta{}
+}
+
+func (m Meta) String() string {
+	var parts []string
+	for _, v := range []string{m.Region, m.Zone, m.Service} {
+		if v != "" {
+			parts = append(parts, v)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func (m Meta) Format() string {
+	var parts []string
+	for _, kv := range [][2]string{{"region", m.Region}, {"zone", m.Zone}, {"service", m.Service}, {"source", m.Source}} {
+		if kv[1] != "" {
+			parts = append(parts, kv[0]+"="+kv[1])
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// NormalizeRange parses line and returns it in canonical form: host bits
+// are cleared (10.1.2.3/8 becomes 10.0.0.0/8), a bare address becomes a
+// single-host prefix, and whitespace around the metadata is collapsed.
+func NormalizeRange(line string) (string, error) {
+	fields := strings.Fields(line)
+	if len(fields) > 0 && !strings.Contains(fields[0], "/") {
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil || addr.Zone() != "" {
+			return "", fmt.Errorf("invalid CIDR %q", fields[0])
+		}
+		fields[0] = netip.PrefixFrom(addr, addr.BitLen()).String()
+	}
+	prefix, m, err := ParseRange(strings.Join(fields, " "))
+	if err != nil {
+		return "", err
+	}
+	if m.IsZero() {
+		return prefix.String(), nil
+	}
+	return prefix.String() + " " + m.Format(), nil
+}
+
+func ParseRange(line string) (netip.Prefix, Meta, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return netip.Prefix{}, Meta{}, fmt.Errorf("empty line")
+	}
+	prefix, err := netip.ParsePrefix(fields[0])
+	if err != nil {
+		return netip.Prefix{}, Meta{}, fmt.Errorf("invalid CIDR %q", fields[0])
+	}
+	var m Meta
+	for _, f := range fields[1:] {
+		key, value, ok := strings.Cut(f, "=")
+		if !ok || value == "" {
+			return netip.Prefix{}, Meta{}, fmt.Errorf("invalid metadata %q", f)
+		}
+		switch key {
+		case "region":
+			m.Region = value
+		case "zone":
+			m.Zone = value
+		case "service":
+			m.Service = value
+		case "source":
+			m.Source = value
+		default:
+			return netip.Prefix{}, Meta{}, fmt.Errorf("unknown metadata key %q", key)
+		}
+	}
+	return prefix.Masked(), m, nil
+}
@@ -0,0 +1,58 @@
+package trie
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"os"
+	"unsafe"
+)
+
+func Open(path string) (*Trie, error) {
+	return open(path, nil)
+}
+
+func open(path string, keys []ed25519.PublicKey) (*Trie, error) {
+	data, err := mmapFile(path)
+	if err != nil {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return decode(data, false, keys)
+	}
+	t, err := decode(data, true, keys)
+	if err != nil {
+		munmap(data)
+		return nil, err
+	}
+	t.mapped = data
+	return t, nil
+}
+
+func (t *Trie) Close() error {
+	if t.mapped == nil {
+		return nil
+	}
+	data := t.mapped
+	t.mapped = nil
+	// Drop every table that points into the mapping, so a lookup after
+	// Close panics instead of faulting on unmapped memory.
+	t.nodes = nil
+	t.pop = nil
+	return munmap(data)
+}
+
+// castSlice reinterprets an on-disk array in place. Record layouts match the
+// in-memory structs on little-endian hosts; anything else is copied.
+func castSlice[T any](raw []byte, count int) ([]T, bool) {
+	var zero T
+	if count == 0 || uintptr(len(raw)) != uintptr(count)*unsafe.Sizeof(zero) {
+		return nil, false
+	}
+	littleEndian := binary.NativeEndian.Uint16([]byte{1, 0}) == 1
+	aligned := uintptr(unsafe.Pointer(&raw[0]))%unsafe.Alignof(zero) == 0
+	if !littleEndian || !aligned {
+		return nil, false
+	}
+	return unsafe.Slice((*T)(unsafe.Pointer(&raw[0])), count), true
+}
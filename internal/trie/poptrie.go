@@ -0,0 +1,344 @@
+package trie
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/netip"
+	"sort"
+)
+
+const stride = 6
+
+type Layout uint16
+
+const (
+	LayoutBinary Layout = iota
+	LayoutPoptrie
+)
+
+func (l Layout) String() string {
+	switch l {
+	case LayoutBinary:
+		return "binary"
+	case LayoutPoptrie:
+		return "poptrie"
+	}
+	return fmt.Sprintf("layout(%d)", uint16(l))
+}
+
+func ParseLayout(s string) (Layout, error) {
+	switch s {
+	case "binary":
+		return LayoutBinary, nil
+	case "poptrie":
+		return LayoutPoptrie, nil
+	}
+	return 0, fmt.Errorf("unknown layout %q (want binary or poptrie)", s)
+}
+
+type popNode struct {
+	vector  uint64
+	leafvec uint64
+	base0   uint32
+	base1   uint32
+}
+
+type route struct {
+	next     uint32
+	provider uint16
+	meta     uint16
+	bits     uint16
+	_        uint16
+}
+
+type poptrie struct {
+	nodes  []popNode
+	leaves []uint32
+	routes []route
+}
+
+func (t *Trie) Layout() Layout {
+	if t.pop != nil {
+		return LayoutPoptrie
+	}
+	return LayoutBinary
+}
+
+func (t *Trie) Compile() {
+	if t.pop != nil {
+		return
+	}
+	c := &compiler{
+		t:         t,
+		p:         &poptrie{nodes: make([]popNode, 2), routes: make([]route, 1)},
+		nodeRoute: make(map[uint32]uint32),
+	}
+	c.fill(root4, root4, 0, 32, 0)
+	c.fill(root6, root6, 0, 128, 0)
+	t.pop = c.p
+	t.nodes = nil
+	t.shadows = nil
+}
+
+type compiler struct {
+	t         *Trie
+	p         *poptrie
+	nodeRoute map[uint32]uint32
+}
+
+func (c *compiler) fill(idx, n uint32, depth, total int, best uint32) {
+	nodes := c.t.nodes
+	var vector, leafvec uint64
+	var kids, kidBest []uint32
+	var last uint32
+	haveLeaf := false
+	leafStart := len(c.p.leaves)
+
+	for v := 0; v < 1<<stride; v++ {
+		cur, b, pos := n, best, depth
+		dead := false
+		for k := 0; k < stride && pos < total; k++ {
+			child := nodes[cur].children[(v>>(stride-1-k))&1]
+			if child == emptyNode {
+				dead = true
+				break
+			}
+			cur = child
+			pos++
+			if nodes[cur].provider != 0 {
+				b = c.route(cur, pos, b)
+			}
+		}
+		if !dead && pos < total && nodes[cur].children != [2]uint32{} {
+			vector |= 1 << uint(v)
+			kids = append(kids, cur)
+			kidBest = append(kidBest, b)
+			continue
+		}
+		if !haveLeaf || b != last {
+			leafvec |= 1 << uint(v)
+			c.p.leaves = append(c.p.leaves, b)
+			last = b
+			haveLeaf = true
+		}
+	}
+
+	base1 := uint32(len(c.p.nodes))
+	c.p.nodes = append(c.p.nodes, make([]popNode, len(kids))...)
+	c.p.nodes[idx] = popNode{vector: vector, leafvec: leafvec, base0: uint32(leafStart), base1: base1}
+	for i, kid := range kids {
+		c.fill(base1+uint32(i), kid, depth+stride, total, kidBest[i])
+	}
+}
+
+func (c *compiler) route(n uint32, bits int, parent uint32) uint32 {
+	if id, ok := c.nodeRoute[n]; ok {
+		return id
+	}
+	shadows := c.t.shadows
+	i := sort.Search(len(shadows), func(i int) bool { return shadows[i].node >= n })
+	j := i
+	for j < len(shadows) && shadows[j].node == n {
+		j++
+	}
+	next := parent
+	for k := j - 1; k >= i; k-- {
+		next = c.addRoute(shadows[k].provider, shadows[k].meta, bits, next)
+	}
+	id := c.addRoute(c.t.nodes[n].provider, c.t.nodes[n].meta, bits, next)
+	c.nodeRoute[n] = id
+	return id
+}
+
+func (c *compiler) addRoute(provider, meta uint16, bits int, next uint32) uint32 {
+	c.p.routes = append(c.p.routes, route{next: next, provider: provider, meta: meta, bits: uint16(bits)})
+	return uint32(len(c.p.routes) - 1)
+}
+
+func (t *Trie) popRoute(addr netip.Addr) uint32 {
+	if addr.Is4() {
+		return t.pop.lookup4(addr4(addr))
+	}
+	hi, lo := addr6(addr)
+	return t.pop.lookup6(hi, lo)
+}
+
+func (t *Trie) popMatch(addr netip.Addr) (Match, bool) {
+	id := t.popRoute(addr)
+	if id == 0 {
+		return Match{}, false
+	}
+	r := t.pop.routes[id]
+	prefix, _ := addr.Prefix(int(r.bits))
+	return t.match(r.provider, r.meta, prefix), true
+}
+
+func (t *Trie) popMatchAll(addr netip.Addr) []Match {
+	var matches []Match
+	for id := t.popRoute(addr); id != 0; id = t.pop.routes[id].next {
+		r := t.pop.routes[id]
+		prefix, _ := addr.Prefix(int(r.bits))
+		matches = append(matches, t.match(r.provider, r.meta, prefix))
+	}
+	return matches
+}
+
+func (p *poptrie) lookup4(ip uint32) uint32 {
+	key := uint64(ip) << 32
+	n := p.nodes[root4]
+	for offset := uint(0); ; offset += stride {
+		v := (key >> (64 - stride - offset)) & (1<<stride - 1)
+		if n.vector&(1<<v) == 0 {
+			return p.leaves[n.base0+uint32(bits.OnesCount64(n.leafvec&(2<<v-1)))-1]
+		}
+		n = p.nodes[n.base1+uint32(bits.OnesCount64(n.vector&(2<<v-1)))-1]
+	}
+}
+
+func (p *poptrie) lookup6(hi, lo uint64) uint32 {
+	n := p.nodes[root6]
+	for offset := uint(0); ; offset += stride {
+		v := extract6(hi, lo, offset)
+		if n.vector&(1<<v) == 0 {
+			return p.leaves[n.base0+uint32(bits.OnesCount64(n.leafvec&(2<<v-1)))-1]
+		}
+		n = p.nodes[n.base1+uint32(bits.OnesCount64(n.vector&(2<<v-1)))-1]
+	}
+}
+
+func extract6(hi, lo uint64, offset uint) uint64 {
+	const mask = 1<<stride - 1
+	switch {
+	case offset+stride <= 64:
+		return (hi >> (64 - stride - offset)) & mask
+	case offset >= 64 && offset+stride <= 128:
+		return (lo >> (128 - stride - offset)) & mask
+	case offset >= 64:
+		return (lo << (offset + stride - 128)) & mask
+	default:
+		return ((hi << (offset + stride - 64)) | (lo >> (128 - stride - offset))) & mask
+	}
+}
+
+func (p *poptrie) encode(w io.Writer) error {
+	buf := make([]byte, popNodeRecordLen)
+	for _, n := range p.nodes {
+		binary.LittleEndian.PutUint64(buf[0:8], n.vector)
+		binary.LittleEndian.PutUint64(buf[8:16], n.leafvec)
+		binary.LittleEndian.PutUint32(buf[16:20], n.base0)
+		binary.LittleEndian.PutUint32(buf[20:24], n.base1)
+		if _, err := w.Write(buf); err != nil {
+			return fmt.Errorf("write poptrie node: %w", err)
+		}
+	}
+	for _, l := range p.leaves {
+		binary.LittleEndian.PutUint32(buf[0:4], l)
+		if _, err := w.Write(buf[:popLeafRecordLen]); err != nil {
+			return fmt.Errorf("write poptrie leaf: %w", err)
+		}
+	}
+	for _, r := range p.routes {
+		binary.LittleEndian.PutUint32(buf[0:4], r.next)
+		binary.LittleEndian.PutUint16(buf[4:6], r.provider)
+		binary.LittleEndian.PutUint16(buf[6:8], r.meta)
+		binary.LittleEndian.PutUint16(buf[8:10], r.bits)
+		binary.LittleEndian.PutUint16(buf[10:12], 0)
+		if _, err := w.Write(buf[:popRouteRecordLen]); err != nil {
+			return fmt.Errorf("write poptrie route: %w", err)
+		}
+	}
+	return nil
+}
+
+// validate checks the poptrie the same way Trie.validate checks the binary
+// layout: child blocks follow their parent, every slot without a child has
+// a leaf, and route chains only point backwards.
+func (p *poptrie) validate(providers, metas int) error {
+	nodes, leaves, routes := uint64(len(p.nodes)), uint64(len(p.leaves)), uint32(len(p.routes))
+	for i, n := range p.nodes {
+		if kids := uint64(bits.OnesCount64(n.vector)); kids > 0 && (n.base1 <= uint32(i) || uint64(n.base1)+kids > nodes) {
+			return corrupt("poptrie node %d has children out of range", i)
+		}
+		if ^n.vector == 0 {
+			continue
+		}
+		if n.leafvec == 0 || bits.TrailingZeros64(n.leafvec) > bits.TrailingZeros64(^n.vector) {
+			return corrupt("poptrie node %d is missing a leaf", i)
+		}
+		if uint64(n.base0)+uint64(bits.OnesCount64(n.leafvec)) > leaves {
+			return corrupt("poptrie node %d has leaves out of range", i)
+		}
+	}
+	for i, l := range p.leaves {
+		if l >= routes {
+			return corrupt("poptrie leaf %d refers to route %d", i, l)
+		}
+	}
+	for i, r := range p.routes {
+		if i > 0 && r.next >= uint32(i) || int(r.provider) >= providers || int(r.meta) >= metas || r.bits > 128 {
+			return corrupt("poptrie route %d out of range", i)
+		}
+	}
+	return nil
+}
+
+func decodePoptrie(data []byte, pos *int, nodeCount, leafCount, routeCount int, zeroCopy bool) (*poptrie, error) {
+	rawNodes, err := section(data, pos, nodeCount, popNodeRecordLen, "poptrie node array")
+	if err != nil {
+		return nil, err
+	}
+	rawLeaves, err := section(data, pos, leafCount, popLeafRecordLen, "poptrie leaf array")
+	if err != nil {
+		return nil, err
+	}
+	rawRoutes, err := section(data, pos, routeCount, popRouteRecordLen, "poptrie route table")
+	if err != nil {
+		return nil, err
+	}
+	if routeCount == 0 {
+		return nil, corrupt("missing poptrie route table")
+	}
+	return &poptrie{
+		nodes:  decodeSection(rawNodes, nodeCount, zeroCopy, copyPopNodes),
+		leaves: decodeSection(rawLeaves, leafCount, zeroCopy, copyLeaves),
+		routes: decodeSection(rawRoutes, routeCount, zeroCopy, copyRoutes),
+	}, nil
+}
+
+func copyPopNodes(data []byte, count int) []popNode {
+	nodes := make([]popNode, count)
+	for i := range nodes {
+		off := i * popNodeRecordLen
+		nodes[i] = popNode{
+			vector:  binary.LittleEndian.Uint64(data[off : off+8]),
+			leafvec: binary.LittleEndian.Uint64(data[off+8 : off+16]),
+			base0:   binary.LittleEndian.Uint32(data[off+16 : off+20]),
+			base1:   binary.LittleEndian.Uint32(data[off+20 : off+24]),
+		}
+	}
+	return nodes
+}
+
+func copyLeaves(data []byte, count int) []uint32 {
+	leaves := make([]uint32, count)
+	for i := range leaves {
+		leaves[i] = binary.LittleEndian.Uint32(data[i*popLeafRecordLen:])
+	}
+	return leaves
+}
+
+func copyRoutes(data []byte, count int) []route {
+	routes := make([]route, count)
+	for i := range routes {
+		off := i * popRouteRecordLen
+		routes[i] = route{
+			next:     binary.LittleEndian.Uint32(data[off : off+4]),
+			provider: binary.LittleEndian.Uint16(data[off+4 : off+6]),
+			meta:     binary.LittleEndian.Uint16(data[off+6 : off+8]),
+			bits:     binary.LittleEndian.Uint16(data[off+8 : off+10]),
+		}
+	}
+	return routes
+}
@@ -1,55 +1,120 @@
 package trie
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
 	"os"
+
+	"github.com/devanshbatham/ip2cloud/internal/atomicfile"
 )
 
 var magic = [4]byte{'I', 'P', '2', 'C'}
 
 const (
-	version       = 1
-	nodeRecordLen = 12
+	version           = 10
+	headerLen         = 72
+	checksumOffset    = 68
+	nodeRecordLen     = 12
+	shadowRecordLen   = 8
+	popNodeRecordLen  = 24
+	popLeafRecordLen  = 4
+	popRouteRecordLen = 12
 )
 
 type header struct {
 	Magic         [4]byte
 	Version       uint16
-	Reserved1     uint16
+	Layout        uint16
 	NodeCount     uint32
 	ProviderCount uint16
-	Reserved2     uint16
+	MetaCount     uint16
+	ShadowCount   uint32
+	LeafCount     uint32
+	RouteCount    uint32
+	Flags         uint32
+	Fingerprint   [32]byte
+	// Reserved keeps the header a multiple of 8 bytes, so mapped poptrie
+	// nodes stay aligned.
+	Reserved uint32
+	// Checksum is the CRC-32C of the header before this field and of
+	// everything after the header up to the signature, if any.
+	Checksum uint32
 }
 
+// flagSigned marks a file followed by an ed25519 signature of everything
+// before it.
+const flagSigned = 1
+
+// ErrCorrupt is returned by Decode, Load and Open for a file whose checksum
+// does not match or whose contents are inconsistent.
+var ErrCorrupt = errors.New("corrupt trie file")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func checksum(hdr, body []byte) uint32 {
+	return crc32.Update(crc32.Checksum(hdr[:checksumOffset], castagnoli), castagnoli, body)
+}
+
+func corrupt(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrCorrupt, fmt.Sprintf(format, args...))
+}
+
+// Save writes the trie to path atomically, so processes that have the old
+// file open or mapped keep reading it intact.
 func (t *Trie) Save(path string) error {
-	f, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	return t.Encode(f)
+	return atomicfile.WriteFile(path, 0644, t.Encode)
 }
 
 func (t *Trie) Encode(w io.Writer) error {
+	if len(t.Providers) > math.MaxUint16 || len(t.Metas) > math.MaxUint16 {
+		return fmt.Errorf("%d providers and %d metadata entries exceed the file format's limit of %d each", len(t.Providers), len(t.Metas), math.MaxUint16)
+	}
 	hdr := header{
 		Magic:         magic,
 		Version:       version,
+		Layout:        uint16(t.Layout()),
 		NodeCount:     uint32(len(t.nodes)),
 		ProviderCount: uint16(len(t.Providers)),
+		MetaCount:     uint16(len(t.Metas)),
+		ShadowCount:   uint32(len(t.shadows)),
+		Fingerprint:   t.Fingerprint,
 	}
-	if err := binary.Write(w, binary.LittleEndian, &hdr); err != nil {
-		return fmt.Errorf("write header: %w", err)
+	if t.pop != nil {
+		hdr.NodeCount = uint32(len(t.pop.nodes))
+		hdr.LeafCount = uint32(len(t.pop.leaves))
+		hdr.RouteCount = uint32(len(t.pop.routes))
 	}
 
-	for _, p := range t.Providers {
-		nameBytes := []byte(p)
-		if err := binary.Write(w, binary.LittleEndian, uint16(len(nameBytes))); err != nil {
-			return fmt.Errorf("write provider name length: %w", err)
-		}
-		if _, err := w.Write(nameBytes); err != nil {
-			return fmt.Errorf("write provider name: %w", err)
+	if t.signKey != nil {
+		hdr.Flags |= flagSigned
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &hdr)
+	if err := t.encodeBody(&buf); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	binary.LittleEndian.PutUint32(data[checksumOffset:headerLen], checksum(data, data[headerLen:]))
+	if t.signKey != nil {
+		data = append(data, ed25519.Sign(t.signKey, data)...)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("write trie: %w", err)
+	}
+	return nil
+}
+
+func (t *Trie) encodeBody(w io.Writer) error {
+	if t.pop != nil {
+		if err := t.pop.encode(w); err != nil {
+			return err
 		}
 	}
 
@@ -58,13 +123,42 @@ func (t *Trie) Encode(w io.Writer) error {
 		binary.LittleEndian.PutUint32(buf[0:4], n.children[0])
 		binary.LittleEndian.PutUint32(buf[4:8], n.children[1])
 		binary.LittleEndian.PutUint16(buf[8:10], n.provider)
-		buf[10] = 0
-		buf[11] = 0
+		binary.LittleEndian.PutUint16(buf[10:12], n.meta)
 		if _, err := w.Write(buf); err != nil {
 			return fmt.Errorf("write node: %w", err)
 		}
 	}
 
+	for _, p := range t.Providers {
+		nameBytes := []byte(p)
+		if err := binary.Write(w, binary.LittleEndian, uint16(len(nameBytes))); err != nil {
+			return fmt.Errorf("write provider name length: %w", err)
+		}
+		if _, err := w.Write(nameBytes); err != nil {
+			return fmt.Errorf("write provider name: %w", err)
+		}
+	}
+
+	for _, m := range t.Metas {
+		for _, field := range []string{m.Region, m.Zone, m.Service, m.Source} {
+			if err := binary.Write(w, binary.LittleEndian, uint16(len(field))); err != nil {
+				return fmt.Errorf("write metadata length: %w", err)
+			}
+			if _, err := io.WriteString(w, field); err != nil {
+				return fmt.Errorf("write metadata: %w", err)
+			}
+		}
+	}
+
+	for _, sh := range t.shadows {
+		binary.LittleEndian.PutUint32(buf[0:4], sh.node)
+		binary.LittleEndian.PutUint16(buf[4:6], sh.provider)
+		binary.LittleEndian.PutUint16(buf[6:8], sh.meta)
+		if _, err := w.Write(buf[:shadowRecordLen]); err != nil {
+			return fmt.Errorf("write shadow: %w", err)
+		}
+	}
+
 	return nil
 }
 
@@ -77,8 +171,30 @@ func Load(path string) (*Trie, error) {
 }
 
 func Decode(data []byte) (*Trie, error) {
-	if len(data) < 16 {
-		return nil, fmt.Errorf("file too short")
+	return decode(data, false, nil)
+}
+
+func copyNodes(data []byte, count int) []node {
+	nodes := make([]node, count)
+	for i := range nodes {
+		off := i * nodeRecordLen
+		nodes[i] = node{
+			children: [2]uint32{
+				binary.LittleEndian.Uint32(data[off : off+4]),
+				binary.LittleEndian.Uint32(data[off+4 : off+8]),
+			},
+			provider: binary.LittleEndian.Uint16(data[off+8 : off+10]),
+			meta:     binary.LittleEndian.Uint16(data[off+10 : off+12]),
+		}
+	}
+	return nodes
+}
+
+// decode parses data, verifying its signature against keys unless keys is
+// empty.
+func decode(data []byte, zeroCopy bool, keys []ed25519.PublicKey) (*Trie, error) {
+	if len(data) < headerLen {
+		return nil, corrupt("file too short")
 	}
 
 	if data[0] != magic[0] || data[1] != magic[1] || data[2] != magic[2] || data[3] != magic[3] {
@@ -89,22 +205,72 @@ func Decode(data []byte) (*Trie, error) {
 	if ver != version {
 		return nil, fmt.Errorf("unsupported version %d", ver)
 	}
+	flags := binary.LittleEndian.Uint32(data[28:32])
+	if flags&^flagSigned != 0 {
+		return nil, fmt.Errorf("unsupported flags %#x", flags)
+	}
+	var sig []byte
+	if flags&flagSigned != 0 {
+		if len(data) < headerLen+ed25519.SignatureSize {
+			return nil, corrupt("truncated signature")
+		}
+		end := len(data) - ed25519.SignatureSize
+		data, sig = data[:end], data[end:]
+	}
+	if sum := binary.LittleEndian.Uint32(data[checksumOffset:headerLen]); sum != checksum(data, data[headerLen:]) {
+		return nil, corrupt("checksum mismatch")
+	}
+	if len(keys) > 0 {
+		if err := verify(data, sig, keys); err != nil {
+			return nil, err
+		}
+	}
 
+	layout := Layout(binary.LittleEndian.Uint16(data[6:8]))
 	nodeCount := binary.LittleEndian.Uint32(data[8:12])
 	providerCount := binary.LittleEndian.Uint16(data[12:14])
+	metaCount := binary.LittleEndian.Uint16(data[14:16])
+	shadowCount := binary.LittleEndian.Uint32(data[16:20])
+	leafCount := binary.LittleEndian.Uint32(data[20:24])
+	routeCount := binary.LittleEndian.Uint32(data[24:28])
+	if nodeCount <= root6 {
+		return nil, corrupt("missing root nodes")
+	}
+	if metaCount == 0 {
+		return nil, corrupt("missing metadata table")
+	}
+
+	pos := headerLen
 
-	pos := 16
+	var nodes []node
+	var pop *poptrie
+	switch layout {
+	case LayoutBinary:
+		raw, err := section(data, &pos, int(nodeCount), nodeRecordLen, "node array")
+		if err != nil {
+			return nil, err
+		}
+		nodes = decodeSection(raw, int(nodeCount), zeroCopy, copyNodes)
+	case LayoutPoptrie:
+		var err error
+		pop, err = decodePoptrie(data, &pos, int(nodeCount), int(leafCount), int(routeCount), zeroCopy)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, corrupt("unsupported layout %d", layout)
+	}
 
 	providers := make([]string, providerCount)
 	provIndex := make(map[string]uint16, providerCount)
 	for i := uint16(0); i < providerCount; i++ {
 		if pos+2 > len(data) {
-			return nil, fmt.Errorf("truncated provider table")
+			return nil, corrupt("truncated provider table")
 		}
 		nameLen := int(binary.LittleEndian.Uint16(data[pos : pos+2]))
 		pos += 2
 		if pos+nameLen > len(data) {
-			return nil, fmt.Errorf("truncated provider name")
+			return nil, corrupt("truncated provider name")
 		}
 		name := string(data[pos : pos+nameLen])
 		providers[i] = name
@@ -114,27 +280,104 @@ func Decode(data []byte) (*Trie, error) {
 		pos += nameLen
 	}
 
-	need := int(nodeCount) * nodeRecordLen
-	if pos+need > len(data) {
-		return nil, fmt.Errorf("truncated node array")
+	metas := make([]Meta, metaCount)
+	metaIndex := make(map[Meta]uint16, metaCount)
+	for i := uint16(0); i < metaCount; i++ {
+		var fields [4]string
+		for j := range fields {
+			if pos+2 > len(data) {
+				return nil, corrupt("truncated metadata table")
+			}
+			fieldLen := int(binary.LittleEndian.Uint16(data[pos : pos+2]))
+			pos += 2
+			if pos+fieldLen > len(data) {
+				return nil, corrupt("truncated metadata entry")
+			}
+			fields[j] = string(data[pos : pos+fieldLen])
+			pos += fieldLen
+		}
+		metas[i] = Meta{Region: fields[0], Zone: fields[1], Service: fields[2], Source: fields[3]}
+		if i != 0 {
+			metaIndex[metas[i]] = i
+		}
 	}
 
-	nodes := make([]node, nodeCount)
-	for i := uint32(0); i < nodeCount; i++ {
-		off := pos + int(i)*nodeRecordLen
-		nodes[i] = node{
-			children: [2]uint32{
-				binary.LittleEndian.Uint32(data[off : off+4]),
-				binary.LittleEndian.Uint32(data[off+4 : off+8]),
-			},
-			provider: binary.LittleEndian.Uint16(data[off+8 : off+10]),
+	if pos+int(shadowCount)*shadowRecordLen > len(data) {
+		return nil, corrupt("truncated shadow table")
+	}
+	shadows := make([]shadow, shadowCount)
+	for i := range shadows {
+		off := pos + i*shadowRecordLen
+		shadows[i] = shadow{
+			node:     binary.LittleEndian.Uint32(data[off : off+4]),
+			provider: binary.LittleEndian.Uint16(data[off+4 : off+6]),
+			meta:     binary.LittleEndian.Uint16(data[off+6 : off+8]),
+		}
+	}
+
+	pos += len(shadows) * shadowRecordLen
+	if pos != len(data) {
+		return nil, corrupt("%d unexpected bytes after shadow table", len(data)-pos)
+	}
+
+	t := &Trie{
+		nodes:       nodes,
+		nextFree:    uint32(len(nodes)),
+		pop:         pop,
+		Providers:   providers,
+		provIndex:   provIndex,
+		Metas:       metas,
+		metaIndex:   metaIndex,
+		shadows:     shadows,
+		Fingerprint: [32]byte(data[32:64]),
+	}
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// validate checks that every index in the trie points inside its table, so
+// a damaged file cannot make lookups panic or loop. Children always come
+// after their parent, which rules out cycles.
+func (t *Trie) validate() error {
+	providers, metas := len(t.Providers), len(t.Metas)
+	for i, n := range t.nodes {
+		for _, c := range n.children {
+			if c != emptyNode && (c <= uint32(i) || c >= uint32(len(t.nodes))) {
+				return corrupt("node %d has child %d out of range", i, c)
+			}
+		}
+		if int(n.provider) >= providers || int(n.meta) >= metas {
+			return corrupt("node %d refers to provider %d, metadata %d", i, n.provider, n.meta)
+		}
+	}
+	for i, sh := range t.shadows {
+		if int(sh.node) >= len(t.nodes) || int(sh.provider) >= providers || int(sh.meta) >= metas {
+			return corrupt("shadow %d out of range", i)
 		}
 	}
+	if t.pop != nil {
+		return t.pop.validate(providers, metas)
+	}
+	return nil
+}
+
+func section(data []byte, pos *int, count, recordLen int, name string) ([]byte, error) {
+	need := count * recordLen
+	if need < 0 || *pos+need > len(data) {
+		return nil, corrupt("truncated %s", name)
+	}
+	raw := data[*pos : *pos+need]
+	*pos += need
+	return raw, nil
+}
 
-	return &Trie{
-		nodes:     nodes,
-		nextFree:  nodeCount,
-		Providers: providers,
-		provIndex: provIndex,
-	}, nil
+func decodeSection[T any](raw []byte, count int, zeroCopy bool, copyFn func([]byte, int) []T) []T {
+	if zeroCopy {
+		if s, ok := castSlice[T](raw, count); ok {
+			return s
+		}
+	}
+	return copyFn(raw, count)
 }
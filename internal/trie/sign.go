@@ -0,0 +1,67 @@
+package trie
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"os"
+)
+
+var (
+	// ErrUnsigned is returned when verification is required and the trie
+	// file carries no signature.
+	ErrUnsigned = errors.New("trie file is not signed")
+	// ErrBadSignature is returned when the signature does not verify with
+	// any of the trusted keys, because the file was changed after signing
+	// or was signed with an untrusted key.
+	ErrBadSignature = errors.New("trie file signature does not match a trusted key")
+
+	errNoKeys = errors.New("no trusted keys to verify the trie file with")
+)
+
+// Sign makes Encode and Save append an ed25519 signature made with key. The
+// signature covers the header and every table, so any change to the file
+// after signing fails verification.
+func (t *Trie) Sign(key ed25519.PrivateKey) {
+	t.signKey = key
+}
+
+// verify checks sig over payload against each key in turn.
+func verify(payload, sig []byte, keys []ed25519.PublicKey) error {
+	if sig == nil {
+		return ErrUnsigned
+	}
+	for _, key := range keys {
+		if ed25519.Verify(key, payload, sig) {
+			return nil
+		}
+	}
+	return ErrBadSignature
+}
+
+// LoadVerified is Load for a file that must be signed by one of keys.
+func LoadVerified(path string, keys []ed25519.PublicKey) (*Trie, error) {
+	if len(keys) == 0 {
+		return nil, errNoKeys
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decode(data, false, keys)
+}
+
+// OpenVerified is Open for a file that must be signed by one of keys.
+func OpenVerified(path string, keys []ed25519.PublicKey) (*Trie, error) {
+	if len(keys) == 0 {
+		return nil, errNoKeys
+	}
+	return open(path, keys)
+}
+
+// DecodeVerified is Decode for data that must be signed by one of keys.
+func DecodeVerified(data []byte, keys []ed25519.PublicKey) (*Trie, error) {
+	if len(keys) == 0 {
+		return nil, errNoKeys
+	}
+	return decode(data, false, keys)
+}
@@ -1,17 +1,43 @@
 package trie
 
 import (
+	"crypto/ed25519"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"net"
+	"net/netip"
 	"sort"
+	"strings"
 )
 
-const emptyNode = 0
+const (
+	emptyNode = 0
+	root4     = 0
+	root6     = 1
+)
 
 type node struct {
 	children [2]uint32
 	provider uint16
+	meta     uint16
+}
+
+type shadow struct {
+	node     uint32
+	provider uint16
+	meta     uint16
+}
+
+type Match struct {
+	Provider string
+	Prefix   netip.Prefix
+	Meta     Meta
+}
+
+type Conflict struct {
+	Prefix    netip.Prefix
+	Providers []string
 }
 
 type Trie struct {
@@ -19,15 +45,27 @@ type Trie struct {
 	nextFree  uint32
 	Providers []string
 	provIndex map[string]uint16
+	Metas     []Meta
+	metaIndex map[Meta]uint16
+	shadows   []shadow
 	Warnings  []string
+	Conflicts []Conflict
+	// Fingerprint identifies the data files the trie was built from. It is
+	// saved with the trie but not computed by Build; zero means unknown.
+	Fingerprint [32]byte
+	pop         *poptrie
+	mapped      []byte
+	signKey     ed25519.PrivateKey
 }
 
 func New() *Trie {
 	return &Trie{
-		nodes:     make([]node, 1, 1<<16),
-		nextFree:  1,
+		nodes:     make([]node, 2, 1<<16),
+		nextFree:  2,
 		Providers: []string{""},
 		provIndex: make(map[string]uint16),
+		Metas:     []Meta{{}},
+		metaIndex: make(map[Meta]uint16),
 	}
 }
 
@@ -40,30 +78,52 @@ func Build(cloudData map[string][]string) *Trie {
 	}
 	sort.Strings(providers)
 
+	conflicts := make(map[netip.Prefix][]string)
 	for _, provider := range providers {
 		cidrs := cloudData[provider]
 		idx := t.providerIdx(provider)
-		for _, cidr := range cidrs {
-			_, network, err := net.ParseCIDR(cidr)
+		for _, line := range cidrs {
+			prefix, meta, err := ParseRange(line)
 			if err != nil {
-				t.Warnings = append(t.Warnings, fmt.Sprintf("%s: invalid CIDR %q", provider, cidr))
+				t.Warnings = append(t.Warnings, fmt.Sprintf("%s: %v", provider, err))
 				continue
 			}
-			ip4 := network.IP.To4()
-			if ip4 == nil {
-				t.Warnings = append(t.Warnings, fmt.Sprintf("%s: skipping IPv6 CIDR %s", provider, cidr))
-				continue
+			root := uint32(root4)
+			if prefix.Addr().Is6() {
+				root = root6
+			}
+			prev := t.insert(root, prefix.Addr().AsSlice(), prefix.Bits(), idx, t.metaIdx(provider, meta))
+			if prev != 0 && prev != idx && !Within(provider, t.Providers[prev]) {
+				if len(conflicts[prefix]) == 0 {
+					conflicts[prefix] = []string{t.Providers[prev]}
+				}
+				conflicts[prefix] = append(conflicts[prefix], provider)
 			}
-			ones, _ := network.Mask.Size()
-			ip := binary.BigEndian.Uint32(ip4)
-			t.insert(ip, ones, idx)
 		}
 	}
 
+	for prefix, names := range conflicts {
+		t.Conflicts = append(t.Conflicts, Conflict{Prefix: prefix, Providers: names})
+	}
+	sort.Slice(t.Conflicts, func(i, j int) bool {
+		a, b := t.Conflicts[i].Prefix, t.Conflicts[j].Prefix
+		if c := a.Addr().Compare(b.Addr()); c != 0 {
+			return c < 0
+		}
+		return a.Bits() < b.Bits()
+	})
+
 	t.nodes = t.nodes[:t.nextFree]
+	t.compactShadows()
 	return t
 }
 
+// Within reports whether provider is parent or one of its descendants in
+// the provider hierarchy, e.g. "aws/ec2/us-east-1" is within "aws/ec2".
+func Within(provider, parent string) bool {
+	return provider == parent || strings.HasPrefix(provider, parent) && provider[len(parent)] == '/'
+}
+
 func (t *Trie) providerIdx(name string) uint16 {
 	if idx, ok := t.provIndex[name]; ok {
 		return idx
@@ -74,6 +134,23 @@ func (t *Trie) providerIdx(name string) uint16 {
 	return idx
 }
 
+func (t *Trie) metaIdx(provider string, m Meta) uint16 {
+	if m.IsZero() {
+		return 0
+	}
+	if idx, ok := t.metaIndex[m]; ok {
+		return idx
+	}
+	if len(t.Metas) >= math.MaxUint16 {
+		t.Warnings = append(t.Warnings, fmt.Sprintf("%s: metadata table full, dropping %q", provider, m.Format()))
+		return 0
+	}
+	idx := uint16(len(t.Metas))
+	t.Metas = append(t.Metas, m)
+	t.metaIndex[m] = idx
+	return idx
+}
+
 func (t *Trie) alloc() uint32 {
 	id := t.nextFree
 	t.nextFree++
@@ -83,10 +160,10 @@ func (t *Trie) alloc() uint32 {
 	return id
 }
 
-func (t *Trie) insert(ip uint32, prefixLen int, provider uint16) {
-	cur := uint32(0)
-	for i := 31; i >= 32-prefixLen; i-- {
-		bit := (ip >> uint(i)) & 1
+func (t *Trie) insert(root uint32, addr []byte, prefixLen int, provider, meta uint16) uint16 {
+	cur := root
+	for i := 0; i < prefixLen; i++ {
+		bit := (addr[i/8] >> uint(7-i%8)) & 1
 		child := t.nodes[cur].children[bit]
 		if child == emptyNode {
 			child = t.alloc()
@@ -94,20 +171,172 @@ func (t *Trie) insert(ip uint32, prefixLen int, provider uint16) {
 		}
 		cur = child
 	}
+	n := t.nodes[cur]
+	if n.provider != 0 && (n.provider != provider || n.meta != meta) {
+		t.shadows = append(t.shadows, shadow{node: cur, provider: n.provider, meta: n.meta})
+	}
 	t.nodes[cur].provider = provider
+	t.nodes[cur].meta = meta
+	return n.provider
+}
+
+func (t *Trie) compactShadows() {
+	sort.SliceStable(t.shadows, func(i, j int) bool {
+		return t.shadows[i].node < t.shadows[j].node
+	})
+	kept := t.shadows[:0]
+	seen := make(map[shadow]bool)
+	for _, sh := range t.shadows {
+		n := t.nodes[sh.node]
+		if seen[sh] || (n.provider == sh.provider && n.meta == sh.meta) {
+			continue
+		}
+		seen[sh] = true
+		kept = append(kept, sh)
+	}
+	t.shadows = kept
 }
 
 func (t *Trie) Lookup(ipStr string) string {
-	ip, ok := ParseIPv4(ipStr)
+	if ip, ok := ParseIPv4(ipStr); ok {
+		return t.Providers[t.lookupRaw(ip)]
+	}
+	addr, ok := parseAddr(ipStr)
 	if !ok {
 		return ""
 	}
+	return t.LookupAddr(addr)
+}
+
+func (t *Trie) LookupAddr(addr netip.Addr) string {
+	addr = addr.Unmap()
+	if addr.Is4() {
+		return t.Providers[t.lookupRaw(addr4(addr))]
+	}
+	if !addr.Is6() {
+		return ""
+	}
+	hi, lo := addr6(addr)
+	return t.Providers[t.lookupRaw6(hi, lo)]
+}
+
+func (t *Trie) LookupUint32(ip uint32) string {
 	return t.Providers[t.lookupRaw(ip)]
 }
 
+func (t *Trie) LookupIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return t.Providers[t.lookupRaw(binary.BigEndian.Uint32(ip4))]
+	}
+	if len(ip) != net.IPv6len {
+		return ""
+	}
+	return t.Providers[t.lookupRaw6(binary.BigEndian.Uint64(ip[:8]), binary.BigEndian.Uint64(ip[8:]))]
+}
+
+func (t *Trie) LookupBatch(addrs []netip.Addr, out []string) int {
+	n := min(len(addrs), len(out))
+	for i := 0; i < n; i++ {
+		out[i] = t.LookupAddr(addrs[i])
+	}
+	return n
+}
+
+func (t *Trie) LookupMatch(ipStr string) (Match, bool) {
+	addr, ok := ParseIP(ipStr)
+	if !ok {
+		return Match{}, false
+	}
+	return t.LookupMatchAddr(addr)
+}
+
+func (t *Trie) LookupMatchAddr(addr netip.Addr) (Match, bool) {
+	addr = addr.WithZone("").Unmap()
+	if !addr.IsValid() {
+		return Match{}, false
+	}
+	if t.pop != nil {
+		return t.popMatch(addr)
+	}
+	var n uint32
+	var bits int
+	if addr.Is4() {
+		n, bits = t.matchRaw(addr4(addr))
+	} else {
+		hi, lo := addr6(addr)
+		n, bits = t.matchRaw6(hi, lo)
+	}
+	if n == emptyNode {
+		return Match{}, false
+	}
+	prefix, _ := addr.Prefix(bits)
+	return t.match(t.nodes[n].provider, t.nodes[n].meta, prefix), true
+}
+
+func (t *Trie) LookupAll(ipStr string) []Match {
+	addr, ok := ParseIP(ipStr)
+	if !ok {
+		return nil
+	}
+	return t.LookupAllAddr(addr)
+}
+
+func (t *Trie) LookupAllAddr(addr netip.Addr) []Match {
+	addr = addr.WithZone("").Unmap()
+	if !addr.IsValid() {
+		return nil
+	}
+	if t.pop != nil {
+		return t.popMatchAll(addr)
+	}
+	var path []uint32
+	if addr.Is4() {
+		path = t.pathRaw(root4, addr.AsSlice())
+	} else {
+		path = t.pathRaw(root6, addr.AsSlice())
+	}
+
+	var matches []Match
+	for i := len(path) - 1; i >= 0; i-- {
+		n := path[i]
+		if t.nodes[n].provider == 0 {
+			continue
+		}
+		prefix, _ := addr.Prefix(i + 1)
+		matches = append(matches, t.match(t.nodes[n].provider, t.nodes[n].meta, prefix))
+		j := sort.Search(len(t.shadows), func(j int) bool { return t.shadows[j].node >= n })
+		for ; j < len(t.shadows) && t.shadows[j].node == n; j++ {
+			matches = append(matches, t.match(t.shadows[j].provider, t.shadows[j].meta, prefix))
+		}
+	}
+	return matches
+}
+
+func (t *Trie) match(provider, meta uint16, prefix netip.Prefix) Match {
+	return Match{Provider: t.Providers[provider], Prefix: prefix, Meta: t.Metas[meta]}
+}
+
+func (t *Trie) pathRaw(root uint32, addr []byte) []uint32 {
+	var path []uint32
+	cur := root
+	for i := 0; i < len(addr)*8; i++ {
+		bit := (addr[i/8] >> uint(7-i%8)) & 1
+		child := t.nodes[cur].children[bit]
+		if child == emptyNode {
+			break
+		}
+		path = append(path, child)
+		cur = child
+	}
+	return path
+}
+
 func (t *Trie) lookupRaw(ip uint32) uint16 {
+	if t.pop != nil {
+		return t.pop.routes[t.pop.lookup4(ip)].provider
+	}
 	var match uint16
-	cur := uint32(0)
+	cur := uint32(root4)
 	nodes := t.nodes
 	for i := 31; i >= 0; i-- {
 		bit := (ip >> uint(i)) & 1
@@ -123,6 +352,104 @@ func (t *Trie) lookupRaw(ip uint32) uint16 {
 	return match
 }
 
+func (t *Trie) lookupRaw6(hi, lo uint64) uint16 {
+	if t.pop != nil {
+		return t.pop.routes[t.pop.lookup6(hi, lo)].provider
+	}
+	var match uint16
+	cur := uint32(root6)
+	nodes := t.nodes
+	for i := 0; i < 128; i++ {
+		var bit uint64
+		if i < 64 {
+			bit = (hi >> uint(63-i)) & 1
+		} else {
+			bit = (lo >> uint(127-i)) & 1
+		}
+		child := nodes[cur].children[bit]
+		if child == emptyNode {
+			break
+		}
+		if nodes[child].provider != 0 {
+			match = nodes[child].provider
+		}
+		cur = child
+	}
+	return match
+}
+
+func (t *Trie) matchRaw(ip uint32) (uint32, int) {
+	var match uint32
+	var bits int
+	cur := uint32(root4)
+	nodes := t.nodes
+	for i := 31; i >= 0; i-- {
+		bit := (ip >> uint(i)) & 1
+		child := nodes[cur].children[bit]
+		if child == emptyNode {
+			break
+		}
+		if nodes[child].provider != 0 {
+			match = child
+			bits = 32 - i
+		}
+		cur = child
+	}
+	return match, bits
+}
+
+func (t *Trie) matchRaw6(hi, lo uint64) (uint32, int) {
+	var match uint32
+	var bits int
+	cur := uint32(root6)
+	nodes := t.nodes
+	for i := 0; i < 128; i++ {
+		var bit uint64
+		if i < 64 {
+			bit = (hi >> uint(63-i)) & 1
+		} else {
+			bit = (lo >> uint(127-i)) & 1
+		}
+		child := nodes[cur].children[bit]
+		if child == emptyNode {
+			break
+		}
+		if nodes[child].provider != 0 {
+			match = child
+			bits = i + 1
+		}
+		cur = child
+	}
+	return match, bits
+}
+
+func ParseIP(s string) (netip.Addr, bool) {
+	if ip, ok := ParseIPv4(s); ok {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], ip)
+		return netip.AddrFrom4(b), true
+	}
+	return parseAddr(s)
+}
+
+func parseAddr(s string) (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.WithZone("").Unmap(), true
+}
+
+func addr4(addr netip.Addr) uint32 {
+	b := addr.As4()
+	return binary.BigEndian.Uint32(b[:])
+}
+
+func addr6(addr netip.Addr) (hi, lo uint64) {
+	b := addr.As16()
+	return binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+}
+
 func ParseIPv4(s string) (uint32, bool) {
 	var ip uint32
 	var octet uint32
@@ -2,13 +2,25 @@ package trie
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
 	"testing"
 )
 
 var testData = map[string][]string{
-	"aws":   {"52.0.0.0/8", "63.32.0.0/14"},
-	"azure": {"64.4.8.0/24"},
+	"aws":   {"52.0.0.0/8", "63.32.0.0/14", "2600:1f00::/24"},
+	"azure": {"64.4.8.0/24", "2603:1000::/25"},
 	"gcp":   {"34.0.0.0/8"},
 }
 
@@ -35,6 +47,9 @@ func TestLookup(t *testing.T) {
 		{"999.1.2.3", ""},
 		{"1.2.3", ""},
 		{"1.2.3.4.5", ""},
+		{"2600:1f18:abcd::1", "aws"},
+		{"2603:1000::1", "azure"},
+		{"2603:1080::1", ""},
 	}
 
 	for _, tt := range tests {
@@ -70,6 +85,342 @@ func TestLongestPrefixMatch(t *testing.T) {
 	}
 }
 
+func TestLookupMatch(t *testing.T) {
+	tr := Build(map[string][]string{
+		"broad":  {"10.0.0.0/8", "2001:db8::/32"},
+		"narrow": {"10.1.2.3/24", "2001:db8:1::/48"},
+	})
+	cases := []struct {
+		ip       string
+		provider string
+		prefix   string
+	}{
+		{"10.1.2.200", "narrow", "10.1.2.0/24"},
+		{"10.9.9.9", "broad", "10.0.0.0/8"},
+		{"2001:db8:1::5", "narrow", "2001:db8:1::/48"},
+		{"2001:db8:2::5", "broad", "2001:db8::/32"},
+		{"::ffff:10.1.2.3", "narrow", "10.1.2.0/24"},
+	}
+	for _, c := range cases {
+		m, ok := tr.LookupMatch(c.ip)
+		if !ok {
+			t.Errorf("LookupMatch(%q) found no match", c.ip)
+			continue
+		}
+		if m.Provider != c.provider || m.Prefix.String() != c.prefix {
+			t.Errorf("LookupMatch(%q) = %s %s, want %s %s", c.ip, m.Provider, m.Prefix, c.provider, c.prefix)
+		}
+	}
+
+	for _, ip := range []string{"192.168.1.1", "2001:db9::1", "invalid", ""} {
+		if m, ok := tr.LookupMatch(ip); ok {
+			t.Errorf("LookupMatch(%q) = %+v, want no match", ip, m)
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	tr := Build(map[string][]string{
+		"aws": {
+			"52.94.0.0/22 region=us-east-1 service=EC2 source=ip-ranges.json",
+			"52.94.0.0/24 region=us-east-1 service=CLOUDFRONT",
+			"2600:1f18::/36 region=us-east-1 service=EC2",
+			"15.181.232.0/21 region=us-east-1 zone=us-east-1-iah-1 service=EC2",
+			"3.0.0.0/8",
+		},
+	})
+	if len(tr.Warnings) != 0 {
+		t.Fatalf("unexpected warnings: %v", tr.Warnings)
+	}
+
+	var buf bytes.Buffer
+	if err := tr.Encode(&buf); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	loaded, err := Decode(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	cases := []struct {
+		ip   string
+		want Meta
+	}{
+		{"52.94.1.1", Meta{Region: "us-east-1", Service: "EC2", Source: "ip-ranges.json"}},
+		{"52.94.0.1", Meta{Region: "us-east-1", Service: "CLOUDFRONT"}},
+		{"2600:1f18::1", Meta{Region: "us-east-1", Service: "EC2"}},
+		{"15.181.232.1", Meta{Region: "us-east-1", Zone: "us-east-1-iah-1", Service: "EC2"}},
+		{"3.1.1.1", Meta{}},
+	}
+	for _, tt := range []*Trie{tr, loaded} {
+		for _, c := range cases {
+			m, ok := tt.LookupMatch(c.ip)
+			if !ok {
+				t.Errorf("LookupMatch(%q) found no match", c.ip)
+				continue
+			}
+			if m.Provider != "aws" || m.Meta != c.want {
+				t.Errorf("LookupMatch(%q) = %s %+v, want aws %+v", c.ip, m.Provider, m.Meta, c.want)
+			}
+		}
+	}
+
+	m, _ := tr.LookupMatch("52.94.1.1")
+	if got := m.Meta.String(); got != "us-east-1 EC2" {
+		t.Errorf("Meta.String() = %q, want %q", got, "us-east-1 EC2")
+	}
+}
+
+func TestMetadataTableLimit(t *testing.T) {
+	ranges := make([]string, 70000)
+	for i := range ranges {
+		ranges[i] = fmt.Sprintf("10.%d.%d.0/24 region=r%d", i>>8, i&0xff, i)
+	}
+	tr := Build(map[string][]string{"aws": ranges})
+	if len(tr.Metas) != math.MaxUint16 {
+		t.Fatalf("len(Metas) = %d, want %d", len(tr.Metas), math.MaxUint16)
+	}
+	if len(tr.Warnings) != len(ranges)-(math.MaxUint16-1) {
+		t.Errorf("got %d warnings, want one per dropped entry", len(tr.Warnings))
+	}
+	loaded, err := Decode(encodeTest(t, tr))
+	if err != nil {
+		t.Fatalf("Decode of a full metadata table: %v", err)
+	}
+	if m, _ := loaded.LookupMatch("10.0.1.1"); m.Meta.Region != "r1" {
+		t.Errorf("LookupMatch(10.0.1.1) region = %q, want r1", m.Meta.Region)
+	}
+
+	tr = New()
+	tr.Metas = make([]Meta, math.MaxUint16+1)
+	if err := tr.Encode(io.Discard); err == nil {
+		t.Error("Encode accepted more metadata entries than the header can count")
+	}
+	tr = New()
+	tr.Providers = make([]string, math.MaxUint16+1)
+	if err := tr.Encode(io.Discard); err == nil {
+		t.Error("Encode accepted more providers than the header can count")
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	prefix, m, err := ParseRange("10.1.2.3/8\tregion=eu-west-1  service=S3")
+	if err != nil {
+		t.Fatalf("ParseRange: %v", err)
+	}
+	if prefix.String() != "10.0.0.0/8" {
+		t.Errorf("prefix = %s, want 10.0.0.0/8", prefix)
+	}
+	if m != (Meta{Region: "eu-west-1", Service: "S3"}) {
+		t.Errorf("meta = %+v", m)
+	}
+	if got := m.Format(); got != "region=eu-west-1 service=S3" {
+		t.Errorf("Format() = %q", got)
+	}
+
+	line := "15.181.232.0/21 region=us-east-1 zone=us-east-1-iah-1 service=EC2"
+	_, m, err = ParseRange(line)
+	if err != nil {
+		t.Fatalf("ParseRange(%q): %v", line, err)
+	}
+	if m.Zone != "us-east-1-iah-1" || m.Format() != "region=us-east-1 zone=us-east-1-iah-1 service=EC2" {
+		t.Errorf("zone meta = %+v, Format() = %q", m, m.Format())
+	}
+
+	for _, line := range []string{"", "not-a-cidr", "10.0.0.0/8 us-east-1", "10.0.0.0/8 color=a", "10.0.0.0/8 region="} {
+		if _, _, err := ParseRange(line); err == nil {
+			t.Errorf("ParseRange(%q) succeeded, want error", line)
+		}
+	}
+}
+
+func TestNormalizeRange(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"10.1.2.3/8", "10.0.0.0/8"},
+		{"192.0.2.5", "192.0.2.5/32"},
+		{"2001:db8::1", "2001:db8::1/128"},
+		{"2001:db8::1/32", "2001:db8::/32"},
+		{" 52.94.1.0/22\tservice=EC2   region=us-east-1 ", "52.94.0.0/22 region=us-east-1 service=EC2"},
+		{"10.0.0.0/8", "10.0.0.0/8"},
+	}
+	for _, c := range cases {
+		got, err := NormalizeRange(c.in)
+		if err != nil || got != c.want {
+			t.Errorf("NormalizeRange(%q) = %q, %v, want %q", c.in, got, err, c.want)
+		}
+	}
+
+	for _, line := range []string{"", "bogus", "10.0.0.0/33", "300.1.1.1", "fe80::1%eth0", "10.0.0.0/8 color=red"} {
+		if got, err := NormalizeRange(line); err == nil {
+			t.Errorf("NormalizeRange(%q) = %q, want error", line, got)
+		}
+	}
+}
+
+func TestLookupAll(t *testing.T) {
+	tr := Build(map[string][]string{
+		"microsoft": {"13.64.0.0/11", "2603:1000::/24"},
+		"azure":     {"13.64.0.0/11", "13.64.1.0/24", "2603:1000::/24"},
+		"apple":     {"17.0.0.0/8"},
+		"relay":     {"17.1.0.0/16"},
+	})
+
+	var buf bytes.Buffer
+	if err := tr.Encode(&buf); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	loaded, err := Decode(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	cases := []struct {
+		ip   string
+		want []string
+	}{
+		{"13.64.1.5", []string{"azure 13.64.1.0/24", "microsoft 13.64.0.0/11", "azure 13.64.0.0/11"}},
+		{"13.65.0.1", []string{"microsoft 13.64.0.0/11", "azure 13.64.0.0/11"}},
+		{"17.1.2.3", []string{"relay 17.1.0.0/16", "apple 17.0.0.0/8"}},
+		{"17.2.2.3", []string{"apple 17.0.0.0/8"}},
+		{"2603:1000::1", []string{"microsoft 2603:1000::/24", "azure 2603:1000::/24"}},
+		{"192.168.1.1", nil},
+		{"invalid", nil},
+	}
+	for _, tt := range []*Trie{tr, loaded} {
+		for _, c := range cases {
+			var got []string
+			for _, m := range tt.LookupAll(c.ip) {
+				got = append(got, m.Provider+" "+m.Prefix.String())
+			}
+			if fmt.Sprint(got) != fmt.Sprint(c.want) {
+				t.Errorf("LookupAll(%q) = %v, want %v", c.ip, got, c.want)
+			}
+		}
+	}
+}
+
+func TestLookupAllDeduplicatesSameProvider(t *testing.T) {
+	tr := Build(map[string][]string{
+		"aws": {"52.0.0.0/8", "52.0.0.0/8", "52.0.0.0/8 service=EC2"},
+	})
+	matches := tr.LookupAll("52.1.1.1")
+	if len(matches) != 2 {
+		t.Fatalf("LookupAll = %+v, want 2 matches", matches)
+	}
+	if matches[0].Meta.Service != "EC2" || !matches[1].Meta.IsZero() {
+		t.Errorf("LookupAll = %+v", matches)
+	}
+}
+
+func TestBuildConflicts(t *testing.T) {
+	tr := Build(map[string][]string{
+		"microsoft":  {"13.64.0.0/11", "2603:1000::/24", "20.0.0.0/8"},
+		"azure":      {"13.64.1.2/11", "2603:1000::/24", "20.1.0.0/16"},
+		"cloudflare": {"104.16.0.0/13"},
+		"cloudlare":  {"104.16.0.0/13", "104.16.0.0/13"},
+		"zeta":       {"13.64.0.0/11"},
+	})
+
+	want := []string{
+		"13.64.0.0/11 [azure microsoft zeta]",
+		"104.16.0.0/13 [cloudflare cloudlare]",
+		"2603:1000::/24 [azure microsoft]",
+	}
+	var got []string
+	for _, c := range tr.Conflicts {
+		got = append(got, fmt.Sprintf("%s %v", c.Prefix, c.Providers))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Conflicts = %v, want %v", got, want)
+	}
+
+	if got := tr.Lookup("13.64.0.1"); got != "zeta" {
+		t.Errorf("Lookup(13.64.0.1) = %q, want %q", got, "zeta")
+	}
+}
+
+func TestWithin(t *testing.T) {
+	cases := []struct {
+		provider, parent string
+		want             bool
+	}{
+		{"aws", "aws", true},
+		{"aws/ec2", "aws", true},
+		{"aws/ec2/us-east-1", "aws/ec2", true},
+		{"aws-gov", "aws", false},
+		{"aws", "aws/ec2", false},
+		{"awsx/ec2", "aws", false},
+	}
+	for _, c := range cases {
+		if got := Within(c.provider, c.parent); got != c.want {
+			t.Errorf("Within(%q, %q) = %v, want %v", c.provider, c.parent, got, c.want)
+		}
+	}
+}
+
+func TestLookupAddrIPUint32(t *testing.T) {
+	tr := Build(testData)
+	cases := []struct{ ip, want string }{
+		{"52.1.2.3", "aws"},
+		{"64.4.8.90", "azure"},
+		{"2600:1f18::1", "aws"},
+		{"::ffff:34.1.2.3", "gcp"},
+		{"192.168.1.1", ""},
+	}
+	for _, c := range cases {
+		addr := netip.MustParseAddr(c.ip)
+		if got := tr.LookupAddr(addr); got != c.want {
+			t.Errorf("LookupAddr(%s) = %q, want %q", c.ip, got, c.want)
+		}
+		if got := tr.LookupIP(net.ParseIP(c.ip)); got != c.want {
+			t.Errorf("LookupIP(%s) = %q, want %q", c.ip, got, c.want)
+		}
+		if addr.Unmap().Is4() {
+			b := addr.Unmap().As4()
+			if got := tr.LookupUint32(binary.BigEndian.Uint32(b[:])); got != c.want {
+				t.Errorf("LookupUint32(%s) = %q, want %q", c.ip, got, c.want)
+			}
+		}
+	}
+	if got := tr.LookupAddr(netip.Addr{}); got != "" {
+		t.Errorf("LookupAddr(zero) = %q, want empty", got)
+	}
+	if got := tr.LookupIP(net.IP{1, 2, 3}); got != "" {
+		t.Errorf("LookupIP(3 bytes) = %q, want empty", got)
+	}
+
+	addrs := []netip.Addr{netip.MustParseAddr("52.1.2.3"), netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("2603:1000::1")}
+	out := make([]string, 2)
+	if n := tr.LookupBatch(addrs, out); n != 2 || out[0] != "aws" || out[1] != "" {
+		t.Errorf("LookupBatch = %d %q", n, out)
+	}
+	out = make([]string, 5)
+	if n := tr.LookupBatch(addrs, out); n != 3 || out[2] != "azure" {
+		t.Errorf("LookupBatch = %d %q", n, out)
+	}
+}
+
+func TestAddrLookupsDoNotAllocate(t *testing.T) {
+	tr := Build(testData)
+	addr4 := netip.MustParseAddr("52.1.2.3")
+	addr6 := netip.MustParseAddr("2600:1f18::1")
+	ip := net.ParseIP("64.4.8.90")
+	addrs := []netip.Addr{addr4, addr6}
+	out := make([]string, len(addrs))
+
+	allocs := testing.AllocsPerRun(100, func() {
+		tr.LookupAddr(addr4)
+		tr.LookupAddr(addr6)
+		tr.LookupIP(ip)
+		tr.LookupUint32(0x34010203)
+		tr.LookupMatchAddr(addr6)
+		tr.LookupBatch(addrs, out)
+	})
+	if allocs != 0 {
+		t.Errorf("got %v allocs per run, want 0", allocs)
+	}
+}
+
 func TestBoundaryAddresses(t *testing.T) {
 	tr := Build(map[string][]string{"test": {"192.168.1.0/24"}})
 	cases := []struct{ ip, want string }{
@@ -98,7 +449,7 @@ func TestSerializeRoundTrip(t *testing.T) {
 		t.Fatalf("Decode: %v", err)
 	}
 
-	ips := []string{"52.1.2.3", "63.33.205.240", "64.4.8.90", "34.100.50.25", "192.168.1.1"}
+	ips := []string{"52.1.2.3", "63.33.205.240", "64.4.8.90", "34.100.50.25", "192.168.1.1", "2600:1f18::1", "2603:1000::1", "2001:db8::1"}
 	for _, ip := range ips {
 		want := original.Lookup(ip)
 		got := loaded.Lookup(ip)
@@ -108,6 +459,317 @@ func TestSerializeRoundTrip(t *testing.T) {
 	}
 }
 
+func TestOpenMapped(t *testing.T) {
+	original := Build(testData)
+	path := filepath.Join(t.TempDir(), "ip2cloud.bin")
+	if err := original.Save(path); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	mapped, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer mapped.Close()
+	if runtime.GOOS == "linux" && mapped.mapped == nil {
+		t.Error("Open fell back to copying on linux")
+	}
+
+	ips := []string{"52.1.2.3", "63.33.205.240", "64.4.8.90", "34.100.50.25", "192.168.1.1", "2600:1f18::1", "2001:db8::1"}
+	for _, ip := range ips {
+		if got, want := mapped.Lookup(ip), original.Lookup(ip); got != want {
+			t.Errorf("mapped Lookup(%q) = %q, want %q", ip, got, want)
+		}
+	}
+
+	if err := mapped.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := mapped.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+}
+
+func TestLookupAfterClose(t *testing.T) {
+	for _, layout := range []Layout{LayoutBinary, LayoutPoptrie} {
+		tr := Build(testData)
+		if layout == LayoutPoptrie {
+			tr.Compile()
+		}
+		path := filepath.Join(t.TempDir(), "ip2cloud.bin")
+		if err := tr.Save(path); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		mapped, err := Open(path)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		if err := mapped.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		for _, ip := range []string{"52.1.2.3", "2600:1f18::1"} {
+			func() {
+				defer func() {
+					if recover() == nil {
+						t.Errorf("%s: Lookup(%q) after Close did not panic", layout, ip)
+					}
+				}()
+				mapped.Lookup(ip)
+			}()
+		}
+	}
+}
+
+func TestOpenRejectsCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip2cloud.bin")
+	if err := os.WriteFile(path, []byte("not a trie file at all"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Fatal("Open succeeded on a corrupt file")
+	}
+	if _, err := Open(filepath.Join(t.TempDir(), "missing.bin")); err == nil {
+		t.Fatal("Open succeeded on a missing file")
+	}
+}
+
+func randomData(rng *rand.Rand) map[string][]string {
+	data := make(map[string][]string)
+	for i := 0; i < 2000; i++ {
+		provider := fmt.Sprintf("p%d", rng.Intn(20))
+		var cidr string
+		if rng.Intn(4) == 0 {
+			cidr = fmt.Sprintf("2001:db8:%x:%x::/%d", rng.Intn(4), rng.Intn(1<<16), 24+rng.Intn(105))
+		} else {
+			cidr = fmt.Sprintf("%d.%d.%d.%d/%d", 10+rng.Intn(4), rng.Intn(256), rng.Intn(256), rng.Intn(256), 8+rng.Intn(25))
+		}
+		if rng.Intn(10) == 0 {
+			cidr += " service=s" + fmt.Sprint(rng.Intn(3))
+		}
+		data[provider] = append(data[provider], cidr)
+	}
+	return data
+}
+
+func randomIP(rng *rand.Rand) string {
+	if rng.Intn(4) == 0 {
+		return fmt.Sprintf("2001:db8:%x:%x:%x::%x", rng.Intn(4), rng.Intn(1<<16), rng.Intn(1<<16), rng.Intn(1<<16))
+	}
+	return fmt.Sprintf("%d.%d.%d.%d", 10+rng.Intn(4), rng.Intn(256), rng.Intn(256), rng.Intn(256))
+}
+
+func encodeTest(t *testing.T, tr *Trie) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := tr.Encode(&buf); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// reseal recomputes the checksum after a test has edited data, so the
+// structural checks are reached.
+func reseal(data []byte) []byte {
+	binary.LittleEndian.PutUint32(data[checksumOffset:headerLen], checksum(data, data[headerLen:]))
+	return data
+}
+
+func TestDecodeDetectsCorruption(t *testing.T) {
+	data := map[string][]string{
+		"aws":   {"52.94.0.0/22 region=us-east-1 service=EC2", "2600:1f18::/36"},
+		"azure": {"13.64.0.0/11", "52.94.0.0/22"},
+	}
+	for _, layout := range []Layout{LayoutBinary, LayoutPoptrie} {
+		tr := Build(data)
+		if layout == LayoutPoptrie {
+			tr.Compile()
+		}
+		good := encodeTest(t, tr)
+		for i := range good {
+			if i >= 4 && i < 6 {
+				continue // magic and version are reported separately
+			}
+			bad := bytes.Clone(good)
+			bad[i] ^= 0x40
+			if _, err := Decode(bad); err == nil {
+				t.Fatalf("%s: Decode accepted a file with byte %d flipped", layout, i)
+			}
+		}
+		if _, err := Decode(good[:headerLen-1]); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: truncated header: err = %v, want ErrCorrupt", layout, err)
+		}
+		if _, err := Decode(append(bytes.Clone(good), 0)); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: trailing byte: err = %v, want ErrCorrupt", layout, err)
+		}
+	}
+}
+
+func TestDecodeValidatesStructure(t *testing.T) {
+	tr := Build(map[string][]string{"aws": {"10.0.0.0/8", "2001:db8::/32"}})
+	good := encodeTest(t, tr)
+	node := func(data []byte, i int) []byte { return data[headerLen+i*nodeRecordLen:] }
+
+	cases := map[string]func(data []byte){
+		"child past the end":     func(d []byte) { binary.LittleEndian.PutUint32(node(d, 0), 1<<30) },
+		"child before parent":    func(d []byte) { binary.LittleEndian.PutUint32(node(d, 2)[4:], 2) },
+		"provider out of range":  func(d []byte) { binary.LittleEndian.PutUint16(node(d, 2)[8:], 99) },
+		"meta out of range":      func(d []byte) { binary.LittleEndian.PutUint16(node(d, 2)[10:], 99) },
+		"missing root nodes":     func(d []byte) { binary.LittleEndian.PutUint32(d[8:], 1) },
+		"unsupported layout":     func(d []byte) { binary.LittleEndian.PutUint16(d[6:], 7) },
+		"missing metadata table": func(d []byte) { binary.LittleEndian.PutUint16(d[14:], 0) },
+		"truncated node array":   func(d []byte) { binary.LittleEndian.PutUint32(d[8:], 1<<20) },
+	}
+	for name, edit := range cases {
+		bad := bytes.Clone(good)
+		edit(bad)
+		if _, err := Decode(reseal(bad)); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: err = %v, want ErrCorrupt", name, err)
+		}
+	}
+
+	tr.Compile()
+	good = encodeTest(t, tr)
+	nodes := int(binary.LittleEndian.Uint32(good[8:12]))
+	leaves := int(binary.LittleEndian.Uint32(good[20:24]))
+	routes := binary.LittleEndian.Uint32(good[24:28])
+	routeTable := headerLen + nodes*popNodeRecordLen + leaves*popLeafRecordLen
+
+	popCases := map[string]func(data []byte){
+		"child block before parent": func(d []byte) { binary.LittleEndian.PutUint32(d[headerLen+20:], 0) },
+		"leaf out of range":         func(d []byte) { binary.LittleEndian.PutUint32(d[routeTable-popLeafRecordLen:], routes) },
+		"route chain points forward": func(d []byte) {
+			binary.LittleEndian.PutUint32(d[routeTable+popRouteRecordLen:], routes-1)
+		},
+		"route provider out of range": func(d []byte) {
+			binary.LittleEndian.PutUint16(d[routeTable+popRouteRecordLen+4:], 99)
+		},
+	}
+	for name, edit := range popCases {
+		bad := bytes.Clone(good)
+		edit(bad)
+		if _, err := Decode(reseal(bad)); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("poptrie %s: err = %v, want ErrCorrupt", name, err)
+		}
+	}
+}
+
+func TestSignedTrie(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := Build(map[string][]string{"aws": {"10.0.0.0/8"}})
+	unsigned := encodeTest(t, tr)
+	tr.Sign(priv)
+	signed := encodeTest(t, tr)
+
+	if _, err := Decode(signed); err != nil {
+		t.Fatalf("Decode of signed file: %v", err)
+	}
+	got, err := DecodeVerified(signed, []ed25519.PublicKey{other, pub})
+	if err != nil {
+		t.Fatalf("DecodeVerified: %v", err)
+	}
+	if p := got.Lookup("10.1.2.3"); p != "aws" {
+		t.Errorf("Lookup = %q, want aws", p)
+	}
+
+	if _, err := DecodeVerified(unsigned, []ed25519.PublicKey{pub}); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("unsigned: err = %v, want ErrUnsigned", err)
+	}
+	if _, err := DecodeVerified(signed, []ed25519.PublicKey{other}); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("untrusted key: err = %v, want ErrBadSignature", err)
+	}
+	tampered := bytes.Clone(signed)
+	copy(tampered[bytes.Index(tampered, []byte("aws")):], "gcp")
+	reseal(tampered[:len(tampered)-ed25519.SignatureSize])
+	if _, err := DecodeVerified(tampered, []ed25519.PublicKey{pub}); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("tampered: err = %v, want ErrBadSignature", err)
+	}
+	if _, err := DecodeVerified(signed, nil); err == nil {
+		t.Error("DecodeVerified with no keys succeeded")
+	}
+
+	path := filepath.Join(t.TempDir(), "signed.bin")
+	if err := tr.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	for name, open := range map[string]func(string, []ed25519.PublicKey) (*Trie, error){
+		"OpenVerified": OpenVerified,
+		"LoadVerified": LoadVerified,
+	} {
+		got, err := open(path, []ed25519.PublicKey{pub})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got.Close()
+	}
+}
+
+func TestPoptrieMatchesBinary(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	data := randomData(rng)
+	binary := Build(data)
+	pop := Build(data)
+	pop.Compile()
+	if pop.Layout() != LayoutPoptrie {
+		t.Fatalf("Layout() = %v, want poptrie", pop.Layout())
+	}
+
+	var buf bytes.Buffer
+	if err := pop.Encode(&buf); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	loaded, err := Decode(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "ip2cloud.bin")
+	if err := pop.Save(path); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	mapped, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer mapped.Close()
+
+	for i := 0; i < 20000; i++ {
+		ip := randomIP(rng)
+		want := binary.Lookup(ip)
+		wantMatch, _ := binary.LookupMatch(ip)
+		wantAll := binary.LookupAll(ip)
+		for name, tr := range map[string]*Trie{"compiled": pop, "decoded": loaded, "mapped": mapped} {
+			if got := tr.Lookup(ip); got != want {
+				t.Fatalf("%s Lookup(%q) = %q, want %q", name, ip, got, want)
+			}
+			if got, _ := tr.LookupMatch(ip); got != wantMatch {
+				t.Fatalf("%s LookupMatch(%q) = %+v, want %+v", name, ip, got, wantMatch)
+			}
+			if got := tr.LookupAll(ip); !slices.Equal(got, wantAll) {
+				t.Fatalf("%s LookupAll(%q) = %v, want %v", name, ip, got, wantAll)
+			}
+		}
+	}
+}
+
+func TestParseLayout(t *testing.T) {
+	for _, l := range []Layout{LayoutBinary, LayoutPoptrie} {
+		got, err := ParseLayout(l.String())
+		if err != nil || got != l {
+			t.Errorf("ParseLayout(%q) = %v, %v", l.String(), got, err)
+		}
+	}
+	if _, err := ParseLayout("btree"); err == nil {
+		t.Error("ParseLayout(btree) succeeded")
+	}
+}
+
 func TestParseIPv4(t *testing.T) {
 	tests := []struct {
 		input string
@@ -132,17 +794,61 @@ func TestParseIPv4(t *testing.T) {
 	}
 }
 
-func TestBuildIPv6Skipped(t *testing.T) {
+func TestBuildIPv6(t *testing.T) {
 	tr := Build(map[string][]string{
 		"gcp": {"2600:1900::/28", "34.0.0.0/8"},
 	})
 
-	if len(tr.Warnings) == 0 {
-		t.Fatal("expected warnings for IPv6 CIDR, got none")
+	if len(tr.Warnings) != 0 {
+		t.Fatalf("unexpected warnings: %v", tr.Warnings)
 	}
 
-	if got := tr.Lookup("34.1.2.3"); got != "gcp" {
-		t.Errorf("Lookup(34.1.2.3) = %q, want %q", got, "gcp")
+	cases := []struct{ ip, want string }{
+		{"34.1.2.3", "gcp"},
+		{"2600:1900::1", "gcp"},
+		{"2600:190f:ffff:ffff:ffff:ffff:ffff:ffff", "gcp"},
+		{"2600:1910::1", ""},
+		{"2001:db8::1", ""},
+		{"::ffff:34.1.2.3", "gcp"},
+		{"fe80::1%eth0", ""},
+		{"2600:1900::1%eth0", "gcp"},
+		{"2600:1900::zz", ""},
+	}
+	for _, c := range cases {
+		if got := tr.Lookup(c.ip); got != c.want {
+			t.Errorf("Lookup(%q) = %q, want %q", c.ip, got, c.want)
+		}
+	}
+}
+
+func TestIPv6LongestPrefixMatch(t *testing.T) {
+	tr := Build(map[string][]string{
+		"broad":  {"2001:db8::/32"},
+		"narrow": {"2001:db8:1::/48"},
+		"host":   {"2001:db8:1::ffff/128"},
+	})
+	cases := []struct{ ip, want string }{
+		{"2001:db8:1::1", "narrow"},
+		{"2001:db8:1::ffff", "host"},
+		{"2001:db8:2::1", "broad"},
+	}
+	for _, c := range cases {
+		if got := tr.Lookup(c.ip); got != c.want {
+			t.Errorf("Lookup(%q) = %q, want %q", c.ip, got, c.want)
+		}
+	}
+}
+
+func TestFamiliesDoNotOverlap(t *testing.T) {
+	tr := Build(map[string][]string{
+		"v4": {"0.0.0.0/1"},
+		"v6": {"::/1"},
+	})
+	if got := tr.Lookup("1.2.3.4"); got != "v4" {
+		t.Errorf("Lookup(1.2.3.4) = %q, want %q", got, "v4")
+	}
+	if got := tr.Lookup("::1"); got != "v6" {
+		t.Errorf("Lookup(::1) = %q, want %q", got, "v6")
 	}
 }
 
@@ -165,8 +871,12 @@ func TestBuildWarningsReported(t *testing.T) {
 		t.Errorf("Lookup(10.0.0.1) = %q, want %q", got, "mixed")
 	}
 
-	if len(tr.Warnings) != 2 {
-		t.Errorf("got %d warnings, want 2: %v", len(tr.Warnings), tr.Warnings)
+	if got := tr.Lookup("2001:db8::1"); got != "mixed" {
+		t.Errorf("Lookup(2001:db8::1) = %q, want %q", got, "mixed")
+	}
+
+	if len(tr.Warnings) != 1 {
+		t.Errorf("got %d warnings, want 1: %v", len(tr.Warnings), tr.Warnings)
 	}
 }
 
@@ -186,6 +896,36 @@ func BenchmarkLookupMiss(b *testing.B) {
 	}
 }
 
+func BenchmarkLookupIPv6(b *testing.B) {
+	tr := Build(testData)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr.Lookup("2600:1f18::1")
+	}
+}
+
+func BenchmarkLookupAddr(b *testing.B) {
+	tr := Build(testData)
+	addr := netip.MustParseAddr("52.1.2.3")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr.LookupAddr(addr)
+	}
+}
+
+func BenchmarkLookupBatch(b *testing.B) {
+	tr := Build(testData)
+	addrs := make([]netip.Addr, 1024)
+	for i := range addrs {
+		addrs[i] = netip.AddrFrom4([4]byte{52, byte(i), byte(i >> 8), 1})
+	}
+	out := make([]string, len(addrs))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr.LookupBatch(addrs, out)
+	}
+}
+
 func BenchmarkLookupParallel(b *testing.B) {
 	tr := Build(testData)
 	ips := []string{"52.1.2.3", "63.33.205.240", "64.4.8.90", "34.100.50.25", "192.168.1.1"}
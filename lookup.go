@@ -0,0 +1,247 @@
+// Package ip2cloud maps IP addresses to the cloud providers that own them.
+package ip2cloud
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/devanshbatham/ip2cloud/internal/store"
+	"github.com/devanshbatham/ip2cloud/internal/trie"
+)
+
+// Result describes the provider range that contains an address.
+type Result struct {
+	Provider string
+	Prefix   netip.Prefix
+	Region   string
+	Zone     string
+	Service  string
+	Source   string
+}
+
+// Label returns the provider followed by the region, zone and service, if
+// known, e.g. "aws us-east-1 EC2".
+func (r Result) Label() string {
+	label := r.Provider
+	for _, v := range []string{r.Region, r.Zone, r.Service} {
+		if v != "" {
+			label += " " + v
+		}
+	}
+	return label
+}
+
+// ParseAddr parses s the same way the string lookups do. IPv4-mapped IPv6
+// addresses are unmapped and zones are dropped.
+func ParseAddr(s string) (netip.Addr, error) {
+	addr, ok := trie.ParseIP(s)
+	if !ok {
+		return netip.Addr{}, fmt.Errorf("invalid IP address %q", s)
+	}
+	return addr, nil
+}
+
+// Within reports whether provider is parent or nested below it. Provider
+// names are hierarchical, so "aws/ec2/us-east-1" is within both "aws/ec2"
+// and "aws".
+func Within(provider, parent string) bool {
+	return trie.Within(provider, parent)
+}
+
+// Lookup matches IP addresses against cloud provider ranges. It is safe for
+// concurrent use.
+type Lookup struct {
+	t *trie.Trie
+}
+
+// New builds a Lookup in memory from the provider data embedded in this
+// package. It does not touch the filesystem.
+func New() (*Lookup, error) {
+	data, err := EmbeddedData()
+	if err != nil {
+		return nil, err
+	}
+	ranges, err := store.ReadRanges(data)
+	if err != nil {
+		return nil, err
+	}
+	return &Lookup{t: trie.Build(ranges)}, nil
+}
+
+// Open loads a Lookup from an ip2cloud.bin file written by "ip2cloud build".
+func Open(path string) (*Lookup, error) {
+	t, err := trie.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Lookup{t: t}, nil
+}
+
+// Load reads an ip2cloud.bin file into memory. Unlike Open it holds no file
+// mapping, so the Lookup can be dropped without calling Close, which suits
+// long-running processes that reload the file.
+func Load(path string) (*Lookup, error) {
+	t, err := trie.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Lookup{t: t}, nil
+}
+
+// Errors returned by OpenVerified and LoadVerified for files that cannot be
+// trusted.
+var (
+	ErrUnsigned     = trie.ErrUnsigned
+	ErrBadSignature = trie.ErrBadSignature
+)
+
+// OpenVerified is Open for a file that must be signed by one of keys, as
+// written by "ip2cloud build -sign".
+func OpenVerified(path string, keys []ed25519.PublicKey) (*Lookup, error) {
+	t, err := trie.OpenVerified(path, keys)
+	if err != nil {
+		return nil, err
+	}
+	return &Lookup{t: t}, nil
+}
+
+// LoadVerified is Load for a file that must be signed by one of keys.
+func LoadVerified(path string, keys []ed25519.PublicKey) (*Lookup, error) {
+	t, err := trie.LoadVerified(path, keys)
+	if err != nil {
+		return nil, err
+	}
+	return &Lookup{t: t}, nil
+}
+
+// Default loads the Lookup used by the ip2cloud command from the user's
+// config directory, building it from the embedded data on first use and
+// rebuilding it when the data directory has changed since. If the config
+// directory has a trusted_keys.pem file, the trie must be signed by one of
+// its keys.
+func Default() (*Lookup, error) {
+	s, err := store.DefaultStore()
+	if err != nil {
+		return nil, err
+	}
+	data, err := EmbeddedData()
+	if err != nil {
+		return nil, err
+	}
+	t, err := s.LoadOrBuildTrie(data)
+	if err != nil {
+		return nil, err
+	}
+	return &Lookup{t: t}, nil
+}
+
+// Close releases the file mapping held by a Lookup returned from Open or
+// Default. The Lookup must not be used afterwards.
+func (l *Lookup) Close() error {
+	return l.t.Close()
+}
+
+// Providers returns the names of all providers known to the Lookup.
+func (l *Lookup) Providers() []string {
+	return append([]string(nil), l.t.Providers[1:]...)
+}
+
+// Warnings returns problems found in the provider data when the Lookup was
+// built, such as invalid CIDRs.
+func (l *Lookup) Warnings() []string {
+	return l.t.Warnings
+}
+
+// Provider returns the provider with the longest matching range for addr,
+// or "" if none matches.
+func (l *Lookup) Provider(addr netip.Addr) string {
+	return l.t.LookupAddr(addr)
+}
+
+// ProviderIP is like Provider but takes a net.IP in either its 4 or 16 byte
+// form.
+func (l *Lookup) ProviderIP(ip net.IP) string {
+	return l.t.LookupIP(ip)
+}
+
+// ProviderUint32 is like Provider for an IPv4 address in host byte order,
+// e.g. 0x08080808 for 8.8.8.8.
+func (l *Lookup) ProviderUint32(ip uint32) string {
+	return l.t.LookupUint32(ip)
+}
+
+// ProviderBatch looks up each address in addrs and stores the provider in
+// the same position of out. It returns the number of results written, which
+// is the minimum of len(addrs) and len(out).
+func (l *Lookup) ProviderBatch(addrs []netip.Addr, out []string) int {
+	return l.t.LookupBatch(addrs, out)
+}
+
+// ProviderString is like Provider but parses s first. Invalid addresses
+// return "".
+func (l *Lookup) ProviderString(s string) string {
+	return l.t.Lookup(s)
+}
+
+// Match returns the longest matching range for addr.
+func (l *Lookup) Match(addr netip.Addr) (Result, bool) {
+	m, ok := l.t.LookupMatchAddr(addr)
+	if !ok {
+		return Result{}, false
+	}
+	return result(m), true
+}
+
+// MatchBatch is the Match equivalent of ProviderBatch. Addresses without a
+// match get the zero Result.
+func (l *Lookup) MatchBatch(addrs []netip.Addr, out []Result) int {
+	n := min(len(addrs), len(out))
+	for i := 0; i < n; i++ {
+		m, _ := l.t.LookupMatchAddr(addrs[i])
+		out[i] = result(m)
+	}
+	return n
+}
+
+// MatchString is like Match but parses s first.
+func (l *Lookup) MatchString(s string) (Result, bool) {
+	m, ok := l.t.LookupMatch(s)
+	if !ok {
+		return Result{}, false
+	}
+	return result(m), true
+}
+
+// All returns every range that contains addr, most specific first.
+func (l *Lookup) All(addr netip.Addr) []Result {
+	return results(l.t.LookupAllAddr(addr))
+}
+
+// AllString is like All but parses s first.
+func (l *Lookup) AllString(s string) []Result {
+	return results(l.t.LookupAll(s))
+}
+
+func result(m trie.Match) Result {
+	return Result{
+		Provider: m.Provider,
+		Prefix:   m.Prefix,
+		Region:   m.Meta.Region,
+		Zone:     m.Meta.Zone,
+		Service:  m.Meta.Service,
+		Source:   m.Meta.Source,
+	}
+}
+
+func results(matches []trie.Match) []Result {
+	if len(matches) == 0 {
+		return nil
+	}
+	out := make([]Result, len(matches))
+	for i, m := range matches {
+		out[i] = result(m)
+	}
+	return out
+}
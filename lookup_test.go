@@ -0,0 +1,113 @@
+package ip2cloud
+
+import (
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+
+	"github.com/devanshbatham/ip2cloud/internal/store"
+)
+
+func TestNewEmbedded(t *testing.T) {
+	l, err := New()
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if got := l.Provider(netip.MustParseAddr("8.8.8.8")); got != "google" {
+		t.Errorf("Provider(8.8.8.8) = %q, want %q", got, "google")
+	}
+	if got := l.ProviderString("8.8.8.8"); got != "google" {
+		t.Errorf("ProviderString(8.8.8.8) = %q, want %q", got, "google")
+	}
+	if got := l.Provider(netip.Addr{}); got != "" {
+		t.Errorf("Provider(zero Addr) = %q, want empty", got)
+	}
+	if got := l.ProviderString("not-an-ip"); got != "" {
+		t.Errorf("ProviderString(not-an-ip) = %q, want empty", got)
+	}
+
+	r, ok := l.Match(netip.MustParseAddr("8.8.8.8"))
+	if !ok || r.Provider != "google" || !r.Prefix.Contains(netip.MustParseAddr("8.8.8.8")) {
+		t.Errorf("Match(8.8.8.8) = %+v, %v", r, ok)
+	}
+
+	providers := l.Providers()
+	if len(providers) == 0 || providers[0] == "" {
+		t.Errorf("Providers() = %v", providers)
+	}
+}
+
+func TestOpenBinFile(t *testing.T) {
+	tmp := t.TempDir()
+	s := &store.Store{
+		DataDir: filepath.Join(tmp, "data"),
+		BinPath: filepath.Join(tmp, "ip2cloud.bin"),
+	}
+	if err := s.AddRanges("aws", []string{"52.94.0.0/22 region=us-east-1 service=EC2", "2600:1f18::/36"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddRanges("relay", []string{"52.94.1.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := Open(s.BinPath)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer l.Close()
+
+	r, ok := l.MatchString("52.94.0.1")
+	if !ok || r.Label() != "aws us-east-1 EC2" || r.Prefix.String() != "52.94.0.0/22" {
+		t.Errorf("MatchString(52.94.0.1) = %+v, %v", r, ok)
+	}
+	if got := l.Provider(netip.MustParseAddr("2600:1f18::1")); got != "aws" {
+		t.Errorf("Provider(2600:1f18::1) = %q, want %q", got, "aws")
+	}
+
+	all := l.All(netip.MustParseAddr("52.94.1.1"))
+	if len(all) != 2 || all[0].Provider != "relay" || all[1].Provider != "aws" {
+		t.Errorf("All(52.94.1.1) = %+v", all)
+	}
+	if all := l.AllString("10.0.0.1"); all != nil {
+		t.Errorf("AllString(10.0.0.1) = %+v, want nil", all)
+	}
+}
+
+func TestAddrAPIs(t *testing.T) {
+	l, err := New()
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if got := l.ProviderIP(net.ParseIP("8.8.8.8")); got != "google" {
+		t.Errorf("ProviderIP(8.8.8.8) = %q, want %q", got, "google")
+	}
+	if got := l.ProviderUint32(0x08080808); got != "google" {
+		t.Errorf("ProviderUint32(0x08080808) = %q, want %q", got, "google")
+	}
+
+	addrs := []netip.Addr{netip.MustParseAddr("8.8.8.8"), netip.MustParseAddr("192.168.1.1")}
+	providers := make([]string, len(addrs))
+	if n := l.ProviderBatch(addrs, providers); n != 2 || providers[0] != "google" || providers[1] != "" {
+		t.Errorf("ProviderBatch = %d %q", n, providers)
+	}
+
+	results := make([]Result, len(addrs))
+	if n := l.MatchBatch(addrs, results); n != 2 || results[0].Provider != "google" || results[1] != (Result{}) {
+		t.Errorf("MatchBatch = %d %+v", n, results)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		l.ProviderBatch(addrs, providers)
+		l.MatchBatch(addrs, results)
+		l.ProviderIP(net.IP{8, 8, 8, 8})
+	})
+	if allocs != 0 {
+		t.Errorf("got %v allocs per run, want 0", allocs)
+	}
+}
@@ -0,0 +1,81 @@
+package ip2cloud
+
+import (
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reloader holds the current Lookup and swaps in a new one when asked to
+// reload. Readers call Lookup on every request and never block: a request
+// that started before a reload finishes against the Lookup it already holds.
+type Reloader struct {
+	load    func() (*Lookup, error)
+	current atomic.Pointer[Lookup]
+	mu      sync.Mutex
+}
+
+// NewReloader calls load once and returns a Reloader serving its result.
+// Loaders should not return Lookups from Open, since replaced Lookups are
+// never closed.
+func NewReloader(load func() (*Lookup, error)) (*Reloader, error) {
+	l, err := load()
+	if err != nil {
+		return nil, err
+	}
+	r := &Reloader{load: load}
+	r.current.Store(l)
+	return r, nil
+}
+
+// Lookup returns the current Lookup.
+func (r *Reloader) Lookup() *Lookup {
+	return r.current.Load()
+}
+
+// Reload calls the loader and swaps in its result. On error the current
+// Lookup is kept.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l, err := r.load()
+	if err != nil {
+		return err
+	}
+	r.current.Store(l)
+	return nil
+}
+
+// WatchFile polls path every interval and reloads when its size,
+// modification time or identity changes, until ctx is done. onReload, if not
+// nil, is called with the result of each reload.
+func (r *Reloader) WatchFile(ctx context.Context, path string, interval time.Duration, onReload func(error)) {
+	last, _ := os.Stat(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		fi, err := os.Stat(path)
+		if err != nil || !changed(last, fi) {
+			continue
+		}
+		last = fi
+		err = r.Reload()
+		if onReload != nil {
+			onReload(err)
+		}
+	}
+}
+
+func changed(old, cur os.FileInfo) bool {
+	if old == nil {
+		return true
+	}
+	return !os.SameFile(old, cur) || old.Size() != cur.Size() || !old.ModTime().Equal(cur.ModTime())
+}
@@ -0,0 +1,107 @@
+package ip2cloud
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/devanshbatham/ip2cloud/internal/store"
+)
+
+func buildBin(t *testing.T, s *store.Store, provider store.ProviderName, cidrs ...string) {
+	t.Helper()
+	if err := s.OverwriteRanges(provider, cidrs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Build(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloaderReload(t *testing.T) {
+	tmp := t.TempDir()
+	s := &store.Store{
+		DataDir: filepath.Join(tmp, "data"),
+		BinPath: filepath.Join(tmp, "ip2cloud.bin"),
+	}
+	buildBin(t, s, "old", "10.0.0.0/8")
+
+	r, err := NewReloader(func() (*Lookup, error) { return Load(s.BinPath) })
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+
+	held := r.Lookup()
+	if got := held.ProviderString("10.0.0.1"); got != "old" {
+		t.Fatalf("before reload: %q, want %q", got, "old")
+	}
+
+	buildBin(t, s, "old", "192.168.0.0/16")
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if got := r.Lookup().ProviderString("192.168.1.1"); got != "old" {
+		t.Errorf("after reload: %q, want %q", got, "old")
+	}
+	if got := held.ProviderString("10.0.0.1"); got != "old" {
+		t.Errorf("previously held Lookup changed: %q, want %q", got, "old")
+	}
+}
+
+func TestReloaderKeepsCurrentOnError(t *testing.T) {
+	calls := 0
+	r, err := NewReloader(func() (*Lookup, error) {
+		calls++
+		if calls > 1 {
+			return nil, errors.New("boom")
+		}
+		return New()
+	})
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+	before := r.Lookup()
+	if err := r.Reload(); err == nil {
+		t.Fatal("Reload succeeded, want error")
+	}
+	if r.Lookup() != before {
+		t.Error("failed reload replaced the current Lookup")
+	}
+}
+
+func TestReloaderWatchFile(t *testing.T) {
+	tmp := t.TempDir()
+	s := &store.Store{
+		DataDir: filepath.Join(tmp, "data"),
+		BinPath: filepath.Join(tmp, "ip2cloud.bin"),
+	}
+	buildBin(t, s, "first", "10.0.0.0/8")
+
+	r, err := NewReloader(func() (*Lookup, error) { return Load(s.BinPath) })
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloaded := make(chan error, 10)
+	go r.WatchFile(ctx, s.BinPath, 10*time.Millisecond, func(err error) { reloaded <- err })
+	// Give WatchFile time to record the initial state of the file.
+	time.Sleep(50 * time.Millisecond)
+
+	buildBin(t, s, "first", "10.0.0.0/8", "172.16.0.0/12", "2001:db8::/32")
+
+	deadline := time.After(5 * time.Second)
+	for r.Lookup().ProviderString("172.16.0.1") != "first" {
+		select {
+		case err := <-reloaded:
+			if err != nil {
+				t.Logf("reload error (retrying): %v", err)
+			}
+		case <-deadline:
+			t.Fatal("WatchFile did not pick up the rebuilt file")
+		}
+	}
+}